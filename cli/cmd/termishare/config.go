@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/qnkhuat/termishare/pkg/termishare"
+)
+
+// env vars to pick the config file and the profile in it
+const (
+	envConfig  = "TERMISHARE_CONFIG"
+	envProfile = "TERMISHARE_PROFILE"
+)
+
+// flags that only make sense for one run, so they can't be set in the config file
+var configIgnoredFlags = map[string]bool{
+	"config":  true,
+	"profile": true,
+	"exec":    true,
+}
+
+// flags printed as <hidden> by 'termishare config show'
+var configSecretFlags = map[string]bool{
+	"passcode":        true,
+	"turn-credential": true,
+	"turn-secret":     true,
+	"server-token":    true,
+	"server-header":   true,
+}
+
+// flags that can be repeated, so can their keys in a section
+var configListFlags = map[string]bool{
+	"server-header": true,
+}
+
+// flags for a signaling server, only set in its [server name] section so they're never sent to another server
+var configServerFlags = map[string]bool{
+	"server-ca":       true,
+	"server-cert":     true,
+	"server-key":      true,
+	"server-insecure": true,
+	"server-token":    true,
+	"server-header":   true,
+}
+
+// The config file is made of "key = value" lines where keys are flag names, e.g.
+//
+//	server = https://termishare.com
+//	escape = ^]
+//
+//	[profile work]
+//	server = work
+//	turn = turns:turn.work.com:5349
+//	turn-secret = ...
+//
+//	[server work]
+//	server-ca = ~/work/ca.pem
+//	server-token = ...
+//
+//	[aliases]
+//	work = https://termishare.work.com
+//
+// Settings before any section apply to every profile, and a profile overrides them
+// A server section, named by an alias or a url, has the -server-* settings used to connect to that server only
+// Aliases are names for servers, usable in -server and in session urls like work/sessionID
+type config struct {
+	path     string
+	profile  string
+	settings map[string]string
+	aliases  map[string]string
+	servers  map[string]map[string]string
+	// the server section applied with applyServer, if any
+	server string
+}
+
+// ~/.config/termishare/config, unless set in env
+func defaultConfigPath() string {
+	if path := os.Getenv(envConfig); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "termishare", "config")
+}
+
+// Load the settings of profile from the config file at path, a missing file is an empty config
+// unless a profile is asked for
+func loadConfig(path string, profile string) (*config, error) {
+	conf := &config{
+		path:     path,
+		profile:  profile,
+		settings: map[string]string{},
+		aliases:  map[string]string{},
+		servers:  map[string]map[string]string{},
+	}
+	if path == "" {
+		return conf, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && profile == "" {
+		return conf, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read config: %s", err)
+	}
+	defer f.Close()
+
+	profiles := map[string]map[string]string{}
+	// where the lines being read go
+	section := conf.settings
+	inAliases, inServer := false, false
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			fields := strings.Fields(line[1 : len(line)-1])
+			switch {
+			case len(fields) == 1 && fields[0] == "aliases":
+				section, inAliases, inServer = conf.aliases, true, false
+			case len(fields) == 2 && fields[0] == "profile":
+				if profiles[fields[1]] == nil {
+					profiles[fields[1]] = map[string]string{}
+				}
+				section, inAliases, inServer = profiles[fields[1]], false, false
+			case len(fields) == 2 && fields[0] == "server":
+				if conf.servers[fields[1]] == nil {
+					conf.servers[fields[1]] = map[string]string{}
+				}
+				section, inAliases, inServer = conf.servers[fields[1]], false, true
+			default:
+				return nil, fmt.Errorf("%s:%d: invalid section %s", path, n, line)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		// paths like ~/recordings
+		if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(value, "~/") {
+			value = filepath.Join(home, value[2:])
+		}
+		if !inAliases && (flag.Lookup(key) == nil || configIgnoredFlags[key]) {
+			return nil, fmt.Errorf("%s:%d: unknown setting %s", path, n, key)
+		}
+		if inServer && !configServerFlags[key] {
+			return nil, fmt.Errorf("%s:%d: %s can't be set in a server section, only server-* settings", path, n, key)
+		}
+		if !inAliases && !inServer && configServerFlags[key] {
+			return nil, fmt.Errorf("%s:%d: %s must be set in the [server name] section of the server it's for", path, n, key)
+		}
+		// values of a repeated key are one per line, they can't contain one
+		if previous, ok := section[key]; ok && configListFlags[key] {
+			value = previous + "\n" + value
+		}
+		section[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read config: %s", err)
+	}
+
+	if profile != "" {
+		settings, ok := profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("Profile %s not found in %s", profile, path)
+		}
+		for key, value := range settings {
+			conf.settings[key] = value
+		}
+	}
+	return conf, nil
+}
+
+// Names of the flags given on the command line
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// Set the flags that weren't given on the command line from the config
+func (conf *config) apply(fs *flag.FlagSet, given map[string]bool) error {
+	return conf.set(fs, given, conf.settings)
+}
+
+// Set the flags of the section of server, an alias or a url, that weren't given on the command line
+// A section named server wins, then the first one by name for the same url
+func (conf *config) applyServer(fs *flag.FlagSet, given map[string]bool, server string) error {
+	if settings, ok := conf.servers[server]; ok {
+		conf.server = server
+		return conf.set(fs, given, settings)
+	}
+	names := make([]string, 0, len(conf.servers))
+	for name := range conf.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	target := normalizeServer(conf.resolveServer(server))
+	for _, name := range names {
+		if normalizeServer(conf.resolveServer(name)) == target {
+			conf.server = name
+			return conf.set(fs, given, conf.servers[name])
+		}
+	}
+	return nil
+}
+
+// A server url as it's printed, so different spellings of it compare equal
+func normalizeServer(server string) string {
+	if serverURL, err := termishare.ParseServerURL(server); err == nil {
+		return serverURL.String()
+	}
+	return server
+}
+
+func (conf *config) set(fs *flag.FlagSet, given map[string]bool, settings map[string]string) error {
+	for key, value := range settings {
+		if given[key] {
+			continue
+		}
+		values := []string{value}
+		if configListFlags[key] {
+			values = strings.Split(value, "\n")
+		}
+		for _, value := range values {
+			if err := fs.Set(key, value); err != nil {
+				return fmt.Errorf("Invalid value %q for %s in %s: %s", value, key, conf.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// The server an alias stands for, or server itself if it's not an alias
+func (conf *config) resolveServer(server string) string {
+	if url, ok := conf.aliases[server]; ok {
+		return url
+	}
+	return server
+}
+
+// Replace an alias in a session url like alias/sessionID
+func (conf *config) resolveSessionURL(url string) string {
+	parts := strings.SplitN(url, "/", 2)
+	if len(parts) == 2 {
+		if server, ok := conf.aliases[parts[0]]; ok {
+			if serverURL, err := termishare.ParseServerURL(server); err == nil {
+				return serverURL.SessionURL(parts[1])
+			}
+			return server + "/" + parts[1]
+		}
+	}
+	return url
+}
+
+// termishare config show: print the effective settings and where they come from
+func (conf *config) show(fs *flag.FlagSet, given map[string]bool) {
+	path := conf.path
+	if path == "" {
+		path = "none"
+	}
+	fmt.Printf("# config: %s\n", path)
+	if conf.profile != "" {
+		fmt.Printf("# profile: %s\n", conf.profile)
+	}
+	if conf.server != "" {
+		fmt.Printf("# server: %s\n", conf.server)
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if configIgnoredFlags[f.Name] {
+			return
+		}
+		value := f.Value.String()
+		if configSecretFlags[f.Name] && value != "" {
+			value = "<hidden>"
+		}
+		source := "default"
+		if given[f.Name] {
+			source = "flag"
+		} else if _, ok := conf.settings[f.Name]; ok {
+			source = "config"
+		} else if _, ok := conf.servers[conf.server][f.Name]; ok {
+			source = "server " + conf.server
+		}
+		fmt.Printf("%s = %s # %s\n", f.Name, value, source)
+	})
+
+	if len(conf.aliases) > 0 {
+		fmt.Printf("\n[aliases]\n")
+		var names []string
+		for name := range conf.aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s = %s\n", name, conf.aliases[name])
+		}
+	}
+}
+
+// A new file in dir to record a session started now
+func recordingPath(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("termishare-%s.cast", time.Now().Format("20060102-150405")))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/qnkhuat/termishare/pkg/recording"
+)
+
+// termishare convert [flags] input output
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	from := fs.String("from", "cast", "Input format: cast, ttyrec or script")
+	to := fs.String("to", "text", "Output format: cast, text, ttyrec or script")
+	timing := fs.String("timing", "", "Timing file, used with the script format")
+	cols := fs.Int("cols", 0, "Terminal width when converting from formats that don't store it")
+	rows := fs.Int("rows", 0, "Terminal height when converting from formats that don't store it")
+	loadKeys := decryptFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: termishare convert [flags] input output\nUse - for stdin/stdout\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("Expected an input and an output file")
+	}
+	if (*from == "script" || *to == "script") && *timing == "" {
+		return fmt.Errorf("The script format requires a -timing file")
+	}
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := openOutput(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// everything goes through a termishare recording
+	var cast io.Reader
+	if *from == "cast" {
+		keys, err := loadKeys()
+		if err != nil {
+			return err
+		}
+		if cast, err = recording.Open(in, keys); err != nil {
+			return err
+		}
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			var err error
+			switch *from {
+			case "ttyrec":
+				err = recording.FromTTYRec(in, pw, *cols, *rows)
+			case "script":
+				var timingFile *os.File
+				timingFile, err = os.Open(*timing)
+				if err == nil {
+					defer timingFile.Close()
+					err = recording.FromScript(in, timingFile, pw, *cols, *rows)
+				}
+			default:
+				err = fmt.Errorf("Unknown input format: %s", *from)
+			}
+			pw.CloseWithError(err)
+		}()
+		cast = pr
+	}
+
+	if *to == "cast" {
+		_, err = io.Copy(out, cast)
+		return err
+	}
+
+	r, err := recording.NewReader(cast)
+	if err != nil {
+		return err
+	}
+
+	switch *to {
+	case "text":
+		return recording.ToText(r, out)
+	case "ttyrec":
+		return recording.ToTTYRec(r, out)
+	case "script":
+		timingFile, err := os.Create(*timing)
+		if err != nil {
+			return err
+		}
+		defer timingFile.Close()
+		return recording.ToScript(r, out, timingFile)
+	default:
+		return fmt.Errorf("Unknown output format: %s", *to)
+	}
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
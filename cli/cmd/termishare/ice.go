@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/qnkhuat/termishare/internal/cfg"
+	"github.com/qnkhuat/termishare/pkg/termishare"
+)
+
+// env vars used when the matching flag isn't set
+const (
+	envICEConfig      = "TERMISHARE_ICE_CONFIG"
+	envSTUN           = "TERMISHARE_STUN"
+	envTURN           = "TERMISHARE_TURN"
+	envTURNUsername   = "TERMISHARE_TURN_USERNAME"
+	envTURNCredential = "TERMISHARE_TURN_CREDENTIAL"
+	envTURNSecret     = "TERMISHARE_TURN_SECRET"
+	envTURNEndpoint   = "TERMISHARE_TURN_CREDENTIAL_URL"
+)
+
+// user part of minted TURN usernames if -turn-username isn't set
+const defaultTURNUser = "termishare"
+
+type iceFlags struct {
+	config     string
+	stun       string
+	turn       string
+	username   string
+	credential string
+	noTurn     bool
+	// the host mints time-limited TURN credentials from secret, or fetches them from endpoint, for each client
+	secret   string
+	endpoint string
+	ttl      time.Duration
+	mint     bool
+}
+
+// STUN and TURN servers to use: a JSON file replaces the default servers,
+// otherwise -stun and -turn replace the default STUN and TURN servers respectively
+func loadICEServers(flags iceFlags) ([]webrtc.ICEServer, error) {
+	config := flagOrEnv(flags.config, envICEConfig)
+	stun := flagOrEnv(flags.stun, envSTUN)
+	turn := flagOrEnv(flags.turn, envTURN)
+	username := flagOrEnv(flags.username, envTURNUsername)
+	credential := flagOrEnv(flags.credential, envTURNCredential)
+
+	var servers []webrtc.ICEServer
+	if config != "" {
+		var err error
+		if servers, err = termishare.LoadICEServers(config); err != nil {
+			return nil, fmt.Errorf("Failed to load ICE servers: %s", err)
+		}
+	} else {
+		stuns := cfg.TERMISHARE_ICE_SERVER_STUNS
+		if stun != "" {
+			var err error
+			if stuns, err = termishare.ParseICEURLs(stun, "", ""); err != nil {
+				return nil, err
+			}
+		}
+		turns := cfg.TERMISHARE_ICE_SERVER_TURNS
+		if turn != "" {
+			var err error
+			if turns, err = termishare.ParseICEURLs(turn, username, credential); err != nil {
+				return nil, err
+			}
+		}
+		servers = append(append(servers, stuns...), turns...)
+	}
+
+	if flags.noTurn {
+		return termishare.WithoutTURN(servers), nil
+	}
+
+	// credentials are added when clients join
+	if flags.mint && turnCredentials(flags) != nil {
+		return servers, nil
+	}
+	return servers, termishare.CheckTURNCredentials(servers)
+}
+
+// How the host gets TURN credentials for each client, nil to use the ones of the servers
+func turnCredentials(flags iceFlags) termishare.TURNCredentialsFunc {
+	if !flags.mint || flags.noTurn {
+		return nil
+	}
+	user := flagOrEnv(flags.username, envTURNUsername)
+	if user == "" {
+		user = defaultTURNUser
+	}
+	if secret := flagOrEnv(flags.secret, envTURNSecret); secret != "" {
+		return termishare.MintTURNCredentials(secret, user, flags.ttl)
+	}
+	if endpoint := flagOrEnv(flags.endpoint, envTURNEndpoint); endpoint != "" {
+		return termishare.EndpointTURNCredentials(endpoint, user)
+	}
+	return nil
+}
+
+func flagOrEnv(value string, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+type icePolicyFlags struct {
+	policy           string
+	interfaces       string
+	networkTypes     string
+	udpPorts         string
+	mdns             string
+	noHostCandidates bool
+}
+
+// The ICE policy of the flags, and whether TURN servers shouldn't be used
+func loadICEPolicy(flags icePolicyFlags) (termishare.ICEPolicy, bool, error) {
+	var policy termishare.ICEPolicy
+	noTurn := false
+	switch flags.policy {
+	case "", "all":
+	case "relay":
+		policy.TransportPolicy = webrtc.ICETransportPolicyRelay
+	case "direct":
+		noTurn = true
+	default:
+		return policy, false, fmt.Errorf("Invalid ICE policy: %s, expected all, relay or direct", flags.policy)
+	}
+
+	var err error
+	if policy.Interfaces, err = termishare.ParseInterfaces(flags.interfaces); err != nil {
+		return policy, false, err
+	}
+	if policy.NetworkTypes, err = termishare.ParseNetworkTypes(flags.networkTypes); err != nil {
+		return policy, false, err
+	}
+	if flags.udpPorts != "" {
+		if policy.PortMin, policy.PortMax, err = termishare.ParsePortRange(flags.udpPorts); err != nil {
+			return policy, false, err
+		}
+	}
+	if policy.MulticastDNS, err = termishare.ParseMulticastDNSMode(flags.mdns); err != nil {
+		return policy, false, err
+	}
+	policy.NoHostCandidates = flags.noHostCandidates
+	return policy, noTurn, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/qnkhuat/termishare/pkg/recording"
+	term "golang.org/x/crypto/ssh/terminal"
+)
+
+// env var to pass the passphrase of encrypted recordings without a prompt
+const envRecordPassphrase = "TERMISHARE_RECORD_PASSPHRASE"
+
+// Register the flags to decrypt recordings, the returned function loads the keys after flags are parsed
+func decryptFlags(fs *flag.FlagSet) func() (recording.Keys, error) {
+	keyFile := fs.String("key", "", "Private key file to decrypt recordings encrypted with a public key")
+	return func() (recording.Keys, error) {
+		keys := recording.Keys{
+			Passphrase: os.Getenv(envRecordPassphrase),
+			AskPassphrase: func() (string, error) {
+				return askPassword("Recording passphrase: ")
+			},
+		}
+		if *keyFile != "" {
+			content, err := os.ReadFile(*keyFile)
+			if err != nil {
+				return keys, err
+			}
+			if keys.PrivateKey, err = recording.ParsePrivateKey(string(content)); err != nil {
+				return keys, err
+			}
+		}
+		return keys, nil
+	}
+}
+
+// Keys to encrypt a host recording: to a public key if given, otherwise with the passphrase from env if set
+// Returns nil if the recording shouldn't be encrypted
+func encryptKeys(publicKeyFile string) (*recording.Keys, error) {
+	if publicKeyFile != "" {
+		content, err := os.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := recording.ParsePublicKey(string(content))
+		if err != nil {
+			return nil, err
+		}
+		return &recording.Keys{PublicKey: key}, nil
+	}
+	if passphrase := os.Getenv(envRecordPassphrase); passphrase != "" {
+		return &recording.Keys{Passphrase: passphrase}, nil
+	}
+	return nil, nil
+}
+
+// Create a recording file, encrypted if a public key file is given or a passphrase is set in env
+func createRecording(path string, publicKeyFile string) (io.WriteCloser, error) {
+	keys, err := encryptKeys(publicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load recording key: %s", err)
+	}
+
+	var f io.WriteCloser
+	f, err = os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create recording file: %s", err)
+	}
+	if keys != nil {
+		if f, err = recording.Encrypt(f, *keys); err != nil {
+			return nil, fmt.Errorf("Failed to encrypt recording: %s", err)
+		}
+	}
+	return f, nil
+}
+
+// termishare keygen name: write a key pair to name.pub and name.key
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: termishare keygen name\nWrite a key pair for recording encryption to name.pub and name.key\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected a name")
+	}
+
+	public, private, err := recording.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(fs.Arg(0), ".key")
+	if err := os.WriteFile(name+".key", []byte(private+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".pub", []byte(public+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Private key: %s.key\nPublic key: %s.pub\n", name, name)
+	return nil
+}
+
+// Read a password from the terminal without echoing it
+func askPassword(prompt string) (string, error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return "", fmt.Errorf("No terminal to ask for a password: %s", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return strings.TrimSpace(string(password)), err
+}
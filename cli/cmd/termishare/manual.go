@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Ask for the offer printed by a host started with -manual
+func readOffer() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("Paste the host's offer: ")
+		offer, err := reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("Failed to read offer: %s", err)
+		}
+		if offer = strings.TrimSpace(offer); offer != "" {
+			return offer, nil
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// env var to pass the passcode of a session without a prompt
+const envPasscode = "TERMISHARE_PASSCODE"
+
+// Passcode to join a session from the first source that is set: the passcode itself, a file,
+// the output of a command (e.g. a password manager) or env
+// Returns false if none is set and the passcode should be asked for
+func loadPasscode(passcode, file, command string) (string, bool, error) {
+	switch {
+	case passcode != "":
+		return passcode, true, nil
+
+	case file != "":
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, fmt.Errorf("Failed to read passcode file: %s", err)
+		}
+		return strings.TrimSpace(string(content)), true, nil
+
+	case command != "":
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", false, fmt.Errorf("Failed to run passcode command: %s", err)
+		}
+		// password managers usually print the password on the first line
+		return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0]), true, nil
+	}
+
+	if passcode, ok := os.LookupEnv(envPasscode); ok {
+		return passcode, true, nil
+	}
+	return "", false, nil
+}
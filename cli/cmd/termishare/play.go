@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/qnkhuat/termishare/pkg/recording"
+)
+
+// termishare play [flags] input
+func play(args []string) error {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Playback speed")
+	idleLimit := fs.Float64("idle-limit", 0, "Shorten pauses longer than this many seconds, 0 to keep them")
+	loadKeys := decryptFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: termishare play [flags] input\nUse - for stdin\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected a recording")
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("Speed must be positive")
+	}
+
+	r, closeInput, err := openRecording(fs.Arg(0), loadKeys)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+
+	last := 0.0
+	return r.Each(func(e recording.Event) error {
+		if e.Type != recording.EOutput {
+			return nil
+		}
+		delay := e.Time - last
+		if *idleLimit > 0 && delay > *idleLimit {
+			delay = *idleLimit
+		}
+		last = e.Time
+		time.Sleep(time.Duration(delay / *speed * float64(time.Second)))
+		_, err := os.Stdout.Write([]byte(e.Data))
+		return err
+	})
+}
+
+// Open a recording for reading, decrypting it if needed
+func openRecording(path string, loadKeys func() (recording.Keys, error)) (*recording.Reader, func() error, error) {
+	in, err := openInput(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := loadKeys()
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	plain, err := recording.Open(in, keys)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	r, err := recording.NewReader(plain)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	return r, in.Close, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/qnkhuat/termishare/pkg/render"
+)
+
+// termishare render [flags] input output
+func renderRecording(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	format := fs.String("format", "svg", "Output format: svg (animated) or html (static snapshots)")
+	at := fs.String("at", "", "Comma separated times in seconds to snapshot, used with html. Defaults to the end of the recording")
+	idleLimit := fs.Float64("idle-limit", 2, "Shorten pauses longer than this many seconds, 0 to keep them, used with svg")
+	fontSize := fs.Int("font-size", 14, "Font size in pixels")
+	loadKeys := decryptFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: termishare render [flags] input output\nUse - for stdin/stdout\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("Expected an input and an output file")
+	}
+
+	times := []float64{}
+	for _, s := range strings.Split(*at, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		t, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid time %q: %s", s, err)
+		}
+		times = append(times, t)
+	}
+
+	r, closeInput, err := openRecording(fs.Arg(0), loadKeys)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+
+	out, err := openOutput(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	opts := render.Options{IdleLimit: *idleLimit, FontSize: *fontSize}
+	switch *format {
+	case "svg":
+		return render.SVG(r, out, opts)
+	case "html":
+		return render.HTML(r, out, times, opts)
+	default:
+		return fmt.Errorf("Unknown format: %s", *format)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/qnkhuat/termishare/pkg/server"
+)
+
+// termishare server [flags]: run a signaling server, the same one as the jar without the web client
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	// same env vars as the jar
+	host := os.Getenv("TERMISHARE_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	port := os.Getenv("TERMISHARE_PORT")
+	if port == "" {
+		port = "3000"
+	}
+	addr := fs.String("addr", net.JoinHostPort(host, port), "Address to listen on, TERMISHARE_HOST and TERMISHARE_PORT by default")
+	tlsCert := fs.String("tls-cert", "", "Certificate file to serve over TLS, with -tls-key")
+	tlsKey := fs.String("tls-key", "", "Private key file of -tls-cert")
+	maxRooms := fs.Int("max-rooms", server.DefaultMaxRooms, "Maximum number of sessions at the same time")
+	maxRoomSize := fs.Int("max-room-size", server.DefaultMaxRoomSize, "Maximum number of connections to a session, the host included")
+	basePath := fs.String("base-path", "", "Path to serve under, e.g. /termishare, when a reverse proxy forwards it as is")
+	maxMessageSize := fs.Int64("max-message-size", server.DefaultMaxMessageSize, "Maximum size of a message in bytes, larger messages close the connection")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: termishare server [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+
+	handler := server.New(server.Options{
+		MaxRooms:       *maxRooms,
+		MaxRoomSize:    *maxRoomSize,
+		MaxMessageSize: *maxMessageSize,
+		BasePath:       *basePath,
+	})
+	log.SetOutput(os.Stdout)
+	if *tlsCert != "" {
+		log.Printf("Serving at https://%s%s", *addr, *basePath)
+		return http.ListenAndServeTLS(*addr, *tlsCert, *tlsKey, handler)
+	}
+	log.Printf("Serving at http://%s%s", *addr, *basePath)
+	return http.ListenAndServe(*addr, handler)
+}
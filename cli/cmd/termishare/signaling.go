@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/qnkhuat/termishare/pkg/termishare"
+)
+
+// env var used when -server-token isn't set, except for defaultServer
+const envServerToken = "TERMISHARE_SERVER_TOKEN"
+
+// the public signaling server, -server's default
+const defaultServer = "https://termishare.com"
+
+// -server-header can be repeated
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if _, _, err := termishare.ParseHeader(value); err != nil {
+		return err
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+type signalingFlags struct {
+	// the signaling server the session is on
+	server   string
+	ca       string
+	cert     string
+	key      string
+	insecure bool
+	token    string
+	headers  headerFlags
+}
+
+// How to connect to the signaling server, from the -server-* flags
+func loadSignalingOptions(flags signalingFlags) (termishare.SignalingOptions, error) {
+	opts := termishare.SignalingOptions{
+		CAFile:             flags.ca,
+		CertFile:           flags.cert,
+		KeyFile:            flags.key,
+		InsecureSkipVerify: flags.insecure,
+		Token:              flags.token,
+	}
+	// unlike the config's server sections the env var isn't for a server, don't send it to the public one
+	if opts.Token == "" && normalizeServer(flags.server) != normalizeServer(defaultServer) {
+		opts.Token = os.Getenv(envServerToken)
+	}
+	if (flags.cert == "") != (flags.key == "") {
+		return opts, fmt.Errorf("-server-cert and -server-key must be set together")
+	}
+	if len(flags.headers) > 0 {
+		opts.Header = http.Header{}
+		for _, header := range flags.headers {
+			name, value, _ := termishare.ParseHeader(header)
+			opts.Header.Add(name, value)
+		}
+	}
+	return opts, nil
+}
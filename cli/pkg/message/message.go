@@ -21,6 +21,10 @@ const (
 
 	TWSPing MType = "Ping"
 
+	// Sent over the config channel to measure the round trip time, answered with a pong with the same data
+	TRTTPing MType = "RTTPing"
+	TRTTPong MType = "RTTPong"
+
 	// Whether or not a connection require a passcode
 	// when connect, client will first send a connect message
 	// server response with whether or not client needs to provide a passcode
@@ -34,6 +38,15 @@ const (
 	TCUnauthenticated = "Unauthenticated"
 
 	TCUnsupportedVersion = "UnsupportedVersion"
+
+	// sent by a client after Connect to tell the host it only watches and never types
+	TCViewer = "Viewer"
+
+	// when the peer connection can't be established, a client asks the host to relay the channels through
+	// the signaling server with its public key, and the host answers with its own, or nothing if it refuses
+	TCRelay = "Relay"
+	// a message of a channel, relayed and encrypted, Data is a RelayData
+	TCRelayData = "RelayData"
 )
 
 type Wrapper struct {
@@ -43,6 +56,14 @@ type Wrapper struct {
 	To   string
 }
 
+type RelayData struct {
+	// label of the data channel the message is for
+	Channel string
+	// the nonce, messages must arrive in order: a replayed index is dropped and a missing one ends the relay
+	Index  uint64
+	Sealed []byte
+}
+
 type Winsize struct {
 	Rows uint16
 	Cols uint16
@@ -21,6 +21,8 @@ type Pty struct {
 	cmd               *exec.Cmd
 	f                 *os.File
 	terminalInitState *term.State
+	// SetWinChangeCB was called
+	followsWinch bool
 }
 
 // *** Getter/Setters ****
@@ -71,6 +73,19 @@ func (pty *Pty) execCommand(command string, envVars []string) error {
 	return nil
 }
 
+// Start a command in a pty of the given size, independent of the terminal termishare runs in
+func (pty *Pty) StartWithSize(command []string, envVars []string, ws *ptyDevice.Winsize) error {
+	pty.cmd = exec.Command(command[0], command[1:]...)
+	pty.cmd.Env = envVars
+
+	f, err := ptyDevice.StartWithSize(pty.cmd, ws)
+	if err != nil {
+		return err
+	}
+	pty.f = f
+	return nil
+}
+
 func (pty *Pty) StartCommand() error {
 	f, err := ptyDevice.Start(pty.cmd)
 	if err != nil {
@@ -81,7 +96,12 @@ func (pty *Pty) StartCommand() error {
 }
 
 func (pty *Pty) Stop() error {
-	signal.Ignore(syscall.SIGWINCH)
+	if pty.followsWinch {
+		signal.Ignore(syscall.SIGWINCH)
+	}
+	if pty.cmd == nil || pty.cmd.Process == nil {
+		return nil
+	}
 
 	err := pty.cmd.Process.Signal(syscall.SIGTERM)
 	// TODO: Find a proper way to close the running command. Perhaps have a timeout after which,
@@ -102,7 +122,7 @@ func (pty *Pty) Refresh() {
 	// TODO: Find a better way to refresh instead of resizing
 	// We wanna force the app to re-draw itself, but there doesn't seem to be a way to do that
 	// so we fake it by resizing the window quickly, making it smaller and then back big
-	winSize, err := GetWinsize(0)
+	winSize, err := pty.Size()
 	if err != nil {
 		return
 	}
@@ -143,6 +163,11 @@ func (pty *Pty) SetWinsize(ws *ptyDevice.Winsize) {
 	ptyDevice.Setsize(pty.f, ws)
 }
 
+// Current size of the pty
+func (pty *Pty) Size() (*ptyDevice.Winsize, error) {
+	return ptyDevice.GetsizeFull(pty.f)
+}
+
 type onWindowChangedCB func(*ptyDevice.Winsize)
 
 func onWindowChanges(wcCB onWindowChangedCB) {
@@ -172,6 +197,7 @@ func onWindowChanges(wcCB onWindowChangedCB) {
 }
 
 func (pty *Pty) SetWinChangeCB(winChangedCB onWindowChangedCB) {
+	pty.followsWinch = true
 	// Start listening for window changes
 	go onWindowChanges(func(ws *ptyDevice.Winsize) {
 		pty.SetWinsize(ws)
@@ -0,0 +1,240 @@
+// Converters between termishare recordings and other terminal recording formats
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qnkhuat/termishare/pkg/vt"
+)
+
+const (
+	defaultCols = 80
+	defaultRows = 24
+	// frames of other formats are a few KB at most, larger ones are from corrupt files
+	maxFrameSize = 16 * 1024 * 1024
+)
+
+// Write a plain-text transcript of the recording to w
+// The recording is played on a virtual screen so what's written is what a viewer would've seen:
+// escape sequences are dropped, redraws only keep their last state, and scrolled-off or cleared lines are kept
+func ToText(r *Reader, w io.Writer) error {
+	header := r.Header()
+	screen := vt.New(orDefault(header.Width, defaultCols), orDefault(header.Height, defaultRows))
+	screen.SetScrollback(-1)
+	screen.SetKeepCleared(true)
+
+	err := r.Each(func(e Event) error {
+		switch e.Type {
+		case EOutput:
+			screen.Write([]byte(e.Data))
+		case EResize:
+			if cols, rows, err := e.Size(); err == nil {
+				screen.Resize(cols, rows)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// full-screen apps leave their content on the alternate screen, show what's underneath like a terminal would on exit
+	if screen.AltScreen() {
+		screen.Write([]byte("\x1b[?1049l"))
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, line := range screen.Scrollback() {
+		fmt.Fprintln(bw, vt.LineString(line))
+	}
+
+	_, rows := screen.Size()
+	lines := make([]string, rows)
+	last := -1
+	for y := 0; y < rows; y++ {
+		lines[y] = vt.LineString(screen.Line(y))
+		if lines[y] != "" {
+			last = y
+		}
+	}
+	for y := 0; y <= last; y++ {
+		fmt.Fprintln(bw, lines[y])
+	}
+	return bw.Flush()
+}
+
+// *** ttyrec ***
+// Each ttyrec record is a 12 bytes header: sec, usec and length as little endian uint32, followed by the data
+
+func ToTTYRec(r *Reader, w io.Writer) error {
+	start := r.Header().Timestamp
+	bw := bufio.NewWriter(w)
+	err := r.Each(func(e Event) error {
+		if e.Type != EOutput {
+			return nil
+		}
+		sec, frac := math.Modf(e.Time)
+		header := [3]uint32{uint32(start + int64(sec)), uint32(frac * 1e6), uint32(len(e.Data))}
+		if err := binary.Write(bw, binary.LittleEndian, header); err != nil {
+			return err
+		}
+		_, err := bw.WriteString(e.Data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Convert a ttyrec file to a recording, ttyrec doesn't store the terminal size so it has to be provided
+func FromTTYRec(r io.Reader, w io.Writer, cols, rows int) error {
+	br := bufio.NewReader(r)
+	var rw *Writer
+	var start time.Time
+	for {
+		header := [3]uint32{}
+		err := binary.Read(br, binary.LittleEndian, &header)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read ttyrec header: %s", err)
+		}
+
+		if header[2] > maxFrameSize {
+			return fmt.Errorf("Invalid ttyrec frame of %d bytes", header[2])
+		}
+		data := make([]byte, header[2])
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("Failed to read ttyrec data: %s", err)
+		}
+
+		t := time.Unix(int64(header[0]), int64(header[1])*1000)
+		if rw == nil {
+			start = t
+			rw, err = NewWriter(w, Header{
+				Width:     orDefault(cols, defaultCols),
+				Height:    orDefault(rows, defaultRows),
+				Timestamp: start.Unix()})
+			if err != nil {
+				return err
+			}
+		}
+		if err := rw.WriteOutput(t.Sub(start).Seconds(), data); err != nil {
+			return err
+		}
+	}
+	if rw == nil {
+		return fmt.Errorf("Empty ttyrec file")
+	}
+	return rw.Flush()
+}
+
+// *** script(1) ***
+// script writes the raw output to a typescript file, and with --timing a file with one "delay bytes" line per chunk
+// scriptreplay skips the first line of the typescript, which is script's "Script started on" header
+
+func ToScript(r *Reader, typescript io.Writer, timing io.Writer) error {
+	header := r.Header()
+	tw := bufio.NewWriter(typescript)
+	mw := bufio.NewWriter(timing)
+	fmt.Fprintf(tw, "Script started on %s [COLUMNS=\"%d\" LINES=\"%d\"]\n",
+		time.Unix(header.Timestamp, 0).Format("2006-01-02 15:04:05-07:00"), header.Width, header.Height)
+
+	last := 0.0
+	err := r.Each(func(e Event) error {
+		if e.Type != EOutput {
+			return nil
+		}
+		fmt.Fprintf(mw, "%f %d\n", math.Max(e.Time-last, 0), len(e.Data))
+		last = e.Time
+		_, err := tw.WriteString(e.Data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return mw.Flush()
+}
+
+func FromScript(typescript io.Reader, timing io.Reader, w io.Writer, cols, rows int) error {
+	tr := bufio.NewReader(typescript)
+	// skip the header line
+	if _, err := tr.ReadString('\n'); err != nil {
+		return fmt.Errorf("Failed to read typescript header: %s", err)
+	}
+
+	rw, err := NewWriter(w, Header{Width: orDefault(cols, defaultCols), Height: orDefault(rows, defaultRows)})
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(timing)
+	elapsed := 0.0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// advanced timing files (script --logging-format advanced) prefix each line with the stream type
+		// only output lines have data in the typescript, input and header lines only advance time
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil && len(fields) >= 3 {
+			if fields[0] != "O" {
+				if delay, err := strconv.ParseFloat(fields[1], 64); err == nil && fields[0] != "H" {
+					elapsed += delay
+				}
+				continue
+			}
+			fields = fields[1:]
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid timing at line %d", lineNo)
+		}
+
+		delay, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return fmt.Errorf("Invalid delay at line %d: %s", lineNo, err)
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("Invalid size at line %d: %s", lineNo, err)
+		}
+		if size < 0 || size > maxFrameSize {
+			return fmt.Errorf("Invalid size at line %d: %d", lineNo, size)
+		}
+
+		data := make([]byte, size)
+		n, err := io.ReadFull(tr, data)
+		elapsed += delay
+		if n > 0 {
+			if err := rw.WriteOutput(elapsed, data[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			// typescript shorter than the timing file, happens when script was killed
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
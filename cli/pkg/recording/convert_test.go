@@ -0,0 +1,210 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// A recording with the given output events, one every half second
+func newRecording(t *testing.T, outputs ...string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	rw, err := NewWriter(&b, Header{Width: 20, Height: 4, Timestamp: 1600000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, output := range outputs {
+		if err := rw.WriteOutput(float64(i)*0.5, []byte(output)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func readEvents(t *testing.T, data []byte) (Header, []Event) {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	if err := r.Each(func(e Event) error {
+		events = append(events, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return r.Header(), events
+}
+
+func checkEvents(t *testing.T, got []Event, outputs ...string) {
+	t.Helper()
+	if len(got) != len(outputs) {
+		t.Fatalf("Expected %d events, got %d: %v", len(outputs), len(got), got)
+	}
+	for i, e := range got {
+		if e.Type != EOutput || e.Data != outputs[i] {
+			t.Errorf("Event %d: got %v, want output %q", i, e, outputs[i])
+		}
+		if math.Abs(e.Time-float64(i)*0.5) > 1e-3 {
+			t.Errorf("Event %d: got time %f, want %f", i, e.Time, float64(i)*0.5)
+		}
+	}
+}
+
+func TestToText(t *testing.T) {
+	tests := []struct {
+		name    string
+		outputs []string
+		want    string
+	}{
+		{"escape sequences are stripped", []string{"\x1b[32m$\x1b[0m ls\r\n", "\x1b[1mfile\x1b[0m\r\n"}, "$ ls\nfile\n"},
+		{"redraws keep their last state", []string{"50%", "\r75%", "\r\x1b[Kdone\r\n"}, "done\n"},
+		{"scrolled-off lines are kept", []string{"1\r\n2\r\n3\r\n", "4\r\n5\r\n6\r\n"}, "1\n2\n3\n4\n5\n6\n"},
+		{"lines before a clear are kept", []string{"secret\r\n", "\x1b[H\x1b[2J\x1b[3J", "after\r\n"}, "secret\nafter\n"},
+		{"full screen apps show what's underneath", []string{"$ vim\r\n", "\x1b[?1049h\x1b[2Jediting"}, "$ vim\n"},
+		{"split utf-8", []string{"\xe6\x97", "\xa5\r\n"}, "日\n"},
+	}
+	for _, tt := range tests {
+		r, err := NewReader(bytes.NewReader(newRecording(t, tt.outputs...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := ToText(r, &b); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, b.String(), tt.want)
+		}
+	}
+}
+
+func TestTTYRecRoundTrip(t *testing.T) {
+	outputs := []string{"hello\r\n", "\x1b[31mred\x1b[0m", "日本\r\n"}
+	r, err := NewReader(bytes.NewReader(newRecording(t, outputs...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ttyrec bytes.Buffer
+	if err := ToTTYRec(r, &ttyrec); err != nil {
+		t.Fatal(err)
+	}
+
+	var converted bytes.Buffer
+	if err := FromTTYRec(&ttyrec, &converted, 100, 30); err != nil {
+		t.Fatal(err)
+	}
+	header, events := readEvents(t, converted.Bytes())
+	if header.Width != 100 || header.Height != 30 || header.Timestamp != 1600000000 {
+		t.Errorf("Unexpected header: %+v", header)
+	}
+	checkEvents(t, events, outputs...)
+}
+
+func TestScriptRoundTrip(t *testing.T) {
+	outputs := []string{"hello\r\n", "\x1b[31mred\x1b[0m", "日本\r\n"}
+	r, err := NewReader(bytes.NewReader(newRecording(t, outputs...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var typescript, timing bytes.Buffer
+	if err := ToScript(r, &typescript, &timing); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(typescript.String(), "Script started on ") {
+		t.Errorf("Expected script's header line, got %q", typescript.String())
+	}
+
+	var converted bytes.Buffer
+	if err := FromScript(&typescript, &timing, &converted, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	header, events := readEvents(t, converted.Bytes())
+	if header.Width != defaultCols || header.Height != defaultRows {
+		t.Errorf("Expected the default size, got %+v", header)
+	}
+	checkEvents(t, events, outputs...)
+}
+
+func TestFromScriptAdvancedTiming(t *testing.T) {
+	typescript := "Script started\nhello"
+	timing := "H 0.000000 START_TIME 2020\nO 0.5 2\nI 0.25 1\nO 0.25 3\n"
+	var converted bytes.Buffer
+	if err := FromScript(strings.NewReader(typescript), strings.NewReader(timing), &converted, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, events := readEvents(t, converted.Bytes())
+	if len(events) != 2 || events[0].Data != "he" || events[1].Data != "llo" || events[1].Time != 1 {
+		t.Errorf("Unexpected events: %v", events)
+	}
+}
+
+func ttyrecFrame(sec, usec, length uint32, data string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, [3]uint32{sec, usec, length})
+	b.WriteString(data)
+	return b.Bytes()
+}
+
+func TestFromTTYRecMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttyrec []byte
+		err    string
+	}{
+		{"empty", nil, "Empty ttyrec file"},
+		{"bad header", []byte{1, 2, 3, 4, 5}, "Failed to read ttyrec header"},
+		{"truncated frame", ttyrecFrame(1, 0, 10, "short"), "Failed to read ttyrec data"},
+		{"huge frame", ttyrecFrame(1, 0, math.MaxUint32, "x"), "Invalid ttyrec frame"},
+		{"truncated second frame", append(ttyrecFrame(1, 0, 2, "ok"), ttyrecFrame(2, 0, 5, "ab")...), "Failed to read ttyrec data"},
+	}
+	for _, tt := range tests {
+		err := FromTTYRec(bytes.NewReader(tt.ttyrec), &bytes.Buffer{}, 0, 0)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestFromScriptMalformed(t *testing.T) {
+	tests := []struct {
+		name       string
+		typescript string
+		timing     string
+		err        string
+	}{
+		{"no header", "", "0.1 1\n", "Failed to read typescript header"},
+		{"negative size", "Script started\nhello", "0.1 -5\n", "Invalid size at line 1"},
+		{"huge size", "Script started\nhello", "0.1 1000000000000\n", "Invalid size at line 1"},
+		{"bad size", "Script started\nhello", "0.1 x\n", "Invalid size at line 1"},
+		{"bad delay", "Script started\nhello", "0.1 1\nsoon 2\n", "Invalid delay at line 2"},
+		{"bad line", "Script started\nhello", "0.1 1 2 3\n", "Invalid timing at line 1"},
+	}
+	for _, tt := range tests {
+		err := FromScript(strings.NewReader(tt.typescript), strings.NewReader(tt.timing), &bytes.Buffer{}, 0, 0)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// script killed before flushing the typescript: keep what's there
+func TestFromScriptTruncated(t *testing.T) {
+	var converted bytes.Buffer
+	err := FromScript(strings.NewReader("Script started\nhel"), strings.NewReader("0.1 2\n0.1 5\n0.1 3\n"), &converted, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, events := readEvents(t, converted.Bytes())
+	if len(events) != 2 || events[0].Data != "he" || events[1].Data != "l" {
+		t.Errorf("Unexpected events: %v", events)
+	}
+}
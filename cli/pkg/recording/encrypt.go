@@ -0,0 +1,356 @@
+// Encryption for recordings at rest
+//
+// An encrypted recording is a header followed by a stream of chunks, each chunk is one Write to the recording
+// sealed on its own with ChaCha20-Poly1305, so if the host crashes only the chunk being written is lost.
+//
+//	header: magic | mode | salt (passphrase mode) or ephemeral public key (public key mode)
+//	chunk:  uint32 big endian length | sealed data
+//
+// The nonce of a chunk is its index, with the first byte set for the last chunk so truncation can be detected
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptedMagic = "TSREC\x00\x01"
+
+	modePassphrase byte = 1
+	modePublicKey  byte = 2
+
+	saltSize     = 16
+	maxChunkSize = 16 * 1024 * 1024
+
+	publicKeyPrefix  = "termishare-public-"
+	privateKeyPrefix = "termishare-private-"
+)
+
+// Keys to encrypt or decrypt a recording
+// Recordings are encrypted to PublicKey if it's set, otherwise with Passphrase
+type Keys struct {
+	Passphrase string
+	PublicKey  []byte
+	PrivateKey []byte
+
+	// called to ask for the passphrase when decrypting a passphrase-encrypted recording without Passphrase
+	AskPassphrase func() (string, error)
+}
+
+// Generate a key pair for public key encryption, encoded as text
+func GenerateKeyPair() (string, string, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return "", "", err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return publicKeyPrefix + base64.RawURLEncoding.EncodeToString(public),
+		privateKeyPrefix + base64.RawURLEncoding.EncodeToString(private), nil
+}
+
+func ParsePublicKey(s string) ([]byte, error) {
+	return parseKey(s, publicKeyPrefix)
+}
+
+func ParsePrivateKey(s string) ([]byte, error) {
+	return parseKey(s, privateKeyPrefix)
+}
+
+func parseKey(s, prefix string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("Key must start with %s", prefix)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key: %s", err)
+	}
+	if len(key) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("Invalid key length: %d", len(key))
+	}
+	return key, nil
+}
+
+// *** Writer ***
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	index  uint64
+	closed bool
+}
+
+// Returns a writer that encrypts everything written to it before writing to w
+// Close must be called to mark the end of the recording
+func Encrypt(w io.Writer, keys Keys) (io.WriteCloser, error) {
+	header := []byte(encryptedMagic)
+	var key []byte
+
+	if keys.PublicKey != nil {
+		ephemeral := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(ephemeral); err != nil {
+			return nil, err
+		}
+		ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := curve25519.X25519(ephemeral, keys.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		header = append(append(header, modePublicKey), ephemeralPublic...)
+		key, err = deriveKey(shared, ephemeralPublic, keys.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	} else if keys.Passphrase != "" {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		header = append(append(header, modePassphrase), salt...)
+		var err error
+		key, err = passphraseKey(keys.Passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("A passphrase or a public key is required to encrypt")
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, fmt.Errorf("Write to closed encrypted recording")
+	}
+	for written := 0; written < len(p); {
+		end := len(p)
+		if end-written > maxChunkSize-ew.aead.Overhead() {
+			end = written + maxChunkSize - ew.aead.Overhead()
+		}
+		if err := ew.writeChunk(p[written:end], false); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return len(p), nil
+}
+
+func (ew *encryptWriter) writeChunk(p []byte, last bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.index, last), p, ew.header)
+	ew.index++
+	chunk := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(chunk, uint32(len(sealed)))
+	_, err := ew.w.Write(append(chunk, sealed...))
+	return err
+}
+
+// Write the last chunk and close the underlying writer if it's a Closer
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	if err := ew.writeChunk(nil, true); err != nil {
+		return err
+	}
+	if c, ok := ew.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// *** Reader ***
+
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	index  uint64
+	buf    []byte
+	done   bool
+}
+
+// Returns r as is if it's not an encrypted recording, otherwise a reader that decrypts it with keys
+func Open(r io.Reader, keys Keys) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(encryptedMagic))
+	if !bytes.Equal(magic, []byte(encryptedMagic)) {
+		return br, nil
+	}
+	return Decrypt(br, keys)
+}
+
+func Decrypt(r io.Reader, keys Keys) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(encryptedMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("Failed to read encryption header: %s", err)
+	}
+	if !bytes.Equal(header[:len(encryptedMagic)], []byte(encryptedMagic)) {
+		return nil, fmt.Errorf("Not an encrypted recording")
+	}
+
+	var key []byte
+	switch mode := header[len(encryptedMagic)]; mode {
+	case modePassphrase:
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(br, salt); err != nil {
+			return nil, fmt.Errorf("Failed to read encryption header: %s", err)
+		}
+		header = append(header, salt...)
+		passphrase := keys.Passphrase
+		if passphrase == "" && keys.AskPassphrase != nil {
+			var err error
+			if passphrase, err = keys.AskPassphrase(); err != nil {
+				return nil, err
+			}
+		}
+		if passphrase == "" {
+			return nil, fmt.Errorf("The recording is encrypted with a passphrase")
+		}
+		var err error
+		key, err = passphraseKey(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+
+	case modePublicKey:
+		ephemeralPublic := make([]byte, curve25519.PointSize)
+		if _, err := io.ReadFull(br, ephemeralPublic); err != nil {
+			return nil, fmt.Errorf("Failed to read encryption header: %s", err)
+		}
+		header = append(header, ephemeralPublic...)
+		if keys.PrivateKey == nil {
+			return nil, fmt.Errorf("The recording is encrypted with a public key, a private key is required")
+		}
+		shared, err := curve25519.X25519(keys.PrivateKey, ephemeralPublic)
+		if err != nil {
+			return nil, err
+		}
+		public, err := curve25519.X25519(keys.PrivateKey, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		key, err = deriveKey(shared, ephemeralPublic, public)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown encryption mode: %d", mode)
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, header: header}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) readChunk() error {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(dr.r, size); err != nil {
+		return dr.truncated(err)
+	}
+	length := binary.BigEndian.Uint32(size)
+	if length > maxChunkSize {
+		return fmt.Errorf("Invalid chunk size: %d", length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(dr.r, sealed); err != nil {
+		return dr.truncated(err)
+	}
+
+	plain, err := dr.aead.Open(nil, chunkNonce(dr.index, false), sealed, dr.header)
+	if err != nil {
+		plain, err = dr.aead.Open(nil, chunkNonce(dr.index, true), sealed, dr.header)
+		if err != nil {
+			if dr.index == 0 {
+				return fmt.Errorf("Failed to decrypt recording, wrong key?")
+			}
+			return fmt.Errorf("Failed to decrypt chunk %d: %s", dr.index, err)
+		}
+		dr.done = true
+	}
+	dr.index++
+	dr.buf = plain
+	return nil
+}
+
+// A recording without its last chunk was not closed properly, keep what we have
+func (dr *decryptReader) truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		log.Printf("Encrypted recording is truncated after %d chunks", dr.index)
+		dr.done = true
+		return nil
+	}
+	return err
+}
+
+// *** Helpers ***
+
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	if last {
+		nonce[0] = 1
+	}
+	return nonce
+}
+
+func passphraseKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+}
+
+func deriveKey(shared, ephemeralPublic, recipientPublic []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublic...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("termishare recording")), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
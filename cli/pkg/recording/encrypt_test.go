@@ -0,0 +1,210 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var chunks = []string{"first chunk\r\n", "second chunk\r\n", "third chunk\r\n"}
+
+// A recording encrypted with keys, one chunk per write
+func encrypted(t *testing.T, keys Keys) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	ew, err := Encrypt(&b, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if _, err := ew.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// Split an encrypted recording in its header and its chunks, with their length
+func splitChunks(t *testing.T, data []byte, headerSize int) ([]byte, [][]byte) {
+	t.Helper()
+	header, rest := data[:headerSize], data[headerSize:]
+	var chunks [][]byte
+	for len(rest) > 0 {
+		size := 4 + int(binary.BigEndian.Uint32(rest))
+		chunks = append(chunks, rest[:size])
+		rest = rest[size:]
+	}
+	return header, chunks
+}
+
+func join(header []byte, chunks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, chunks...), nil)
+}
+
+func decrypt(data []byte, keys Keys) (string, error) {
+	r, err := Open(bytes.NewReader(data), keys)
+	if err != nil {
+		return "", err
+	}
+	plain, err := io.ReadAll(r)
+	return string(plain), err
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	public, private, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ParsePublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := ParsePrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join(chunks, "")
+
+	for name, keys := range map[string][2]Keys{
+		"passphrase": {{Passphrase: "correct horse"}, {Passphrase: "correct horse"}},
+		"asked passphrase": {{Passphrase: "correct horse"},
+			{AskPassphrase: func() (string, error) { return "correct horse", nil }}},
+		"public key": {{PublicKey: publicKey}, {PrivateKey: privateKey}},
+	} {
+		data := encrypted(t, keys[0])
+		if bytes.Contains(data, []byte("chunk")) {
+			t.Errorf("%s: the recording isn't encrypted", name)
+		}
+		got, err := decrypt(data, keys[1])
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	// recordings that aren't encrypted are read as is
+	if got, err := decrypt([]byte("plain recording"), Keys{}); err != nil || got != "plain recording" {
+		t.Errorf("Expected a plain recording to be read as is, got %q, %v", got, err)
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	_, private, _ := GenerateKeyPair()
+	otherPrivate, _ := ParsePrivateKey(private)
+	public, _, _ := GenerateKeyPair()
+	publicKey, _ := ParsePublicKey(public)
+
+	withPassphrase := encrypted(t, Keys{Passphrase: "correct horse"})
+	withPublicKey := encrypted(t, Keys{PublicKey: publicKey})
+	tests := []struct {
+		name string
+		data []byte
+		keys Keys
+		err  string
+	}{
+		{"wrong passphrase", withPassphrase, Keys{Passphrase: "battery staple"}, "wrong key?"},
+		{"no passphrase", withPassphrase, Keys{}, "encrypted with a passphrase"},
+		{"wrong private key", withPublicKey, Keys{PrivateKey: otherPrivate}, "wrong key?"},
+		{"no private key", withPublicKey, Keys{Passphrase: "correct horse"}, "a private key is required"},
+	}
+	for _, tt := range tests {
+		_, err := decrypt(tt.data, tt.keys)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	keys := Keys{Passphrase: "correct horse"}
+	headerSize := len(encryptedMagic) + 1 + saltSize
+	header, parts := splitChunks(t, encrypted(t, keys), headerSize)
+	if len(parts) != len(chunks)+1 {
+		t.Fatalf("Expected %d chunks and the last one, got %d", len(chunks), len(parts))
+	}
+
+	flipped := func(b []byte, i int) []byte {
+		b = append([]byte{}, b...)
+		b[i] ^= 1
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"flipped ciphertext byte", join(header, parts[0], flipped(parts[1], 6), parts[2], parts[3])},
+		{"flipped salt byte", join(flipped(header, headerSize-1), parts...)},
+		{"reordered chunks", join(header, parts[0], parts[2], parts[1], parts[3])},
+		{"dropped chunk", join(header, parts[0], parts[2], parts[3])},
+		{"repeated chunk", join(header, parts[0], parts[0], parts[1], parts[2], parts[3])},
+		{"last chunk moved", join(header, parts[0], parts[3], parts[1], parts[2])},
+	}
+	for _, tt := range tests {
+		if got, err := decrypt(tt.data, keys); err == nil {
+			t.Errorf("%s: expected an error, got %q", tt.name, got)
+		}
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	keys := Keys{Passphrase: "correct horse"}
+	data := encrypted(t, keys)
+	header, parts := splitChunks(t, data, len(encryptedMagic)+1+saltSize)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"without the last chunk", join(header, parts[:3]...), strings.Join(chunks, "")},
+		{"in the middle of a chunk", join(header, parts[0], parts[1][:10]), chunks[0]},
+		{"in the middle of a chunk size", join(header, parts[0], parts[1][:2]), chunks[0]},
+	}
+	for _, tt := range tests {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		got, err := decrypt(tt.data, keys)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if !strings.Contains(logs.String(), "Encrypted recording is truncated") {
+			t.Errorf("%s: expected a warning about the truncation, got %q", tt.name, logs.String())
+		}
+	}
+
+	// a complete recording doesn't warn
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	_, err := decrypt(data, keys)
+	log.SetOutput(os.Stderr)
+	if err != nil || logs.Len() > 0 {
+		t.Errorf("Expected a complete recording without warning, got %v, %q", err, logs.String())
+	}
+}
+
+func TestEncryptWriteAfterClose(t *testing.T) {
+	ew, err := Encrypt(&bytes.Buffer{}, Keys{Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ew.Close()
+	if _, err := ew.Write([]byte("late")); err == nil {
+		t.Error("Expected writing after Close to fail")
+	}
+	if _, err := Encrypt(&bytes.Buffer{}, Keys{}); err == nil {
+		t.Error("Expected encrypting without a key to fail")
+	}
+}
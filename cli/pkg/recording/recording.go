@@ -0,0 +1,251 @@
+/*
+Termishare session recordings
+A recording is an asciicast v2 file (https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md):
+a JSON header on the first line, then one [time, type, data] event per line
+*/
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const Version = 2
+
+type EventType string
+
+const (
+	EOutput EventType = "o" // data written to the terminal
+	EInput  EventType = "i" // data typed by the user
+	EResize EventType = "r" // terminal resized, data is COLSxROWS
+)
+
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type Event struct {
+	// seconds since the start of the recording
+	Time float64
+	Type EventType
+	Data string
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return fmt.Errorf("Event must have 3 elements, got %d", len(raw))
+	}
+	if err := json.Unmarshal(raw[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[1], &e.Type); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw[2], &e.Data)
+}
+
+// Parse the data of a resize event
+func (e Event) Size() (int, int, error) {
+	parts := strings.SplitN(e.Data, "x", 2)
+	if e.Type != EResize || len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Not a resize event: %v", e)
+	}
+	cols, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	rows, err := strconv.Atoi(parts[1])
+	return cols, rows, err
+}
+
+// *** Writer ***
+
+type Writer struct {
+	w       io.Writer
+	lock    sync.Mutex
+	start   time.Time
+	encoder *json.Encoder
+
+	// trailing bytes of an incomplete utf-8 sequence, kept until the rest arrives
+	pending []byte
+}
+
+// Write the header and return a writer to record events to w
+// Event times are relative to the header's timestamp, or now if it's not set
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	header.Version = Version
+	start := time.Now()
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	} else {
+		start = time.Unix(header.Timestamp, 0)
+	}
+
+	rw := &Writer{w: w, start: start, encoder: json.NewEncoder(w)}
+	rw.encoder.SetEscapeHTML(false)
+	if err := rw.encoder.Encode(header); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Record output at the current time. Implements io.Writer so it can be used with io.MultiWriter
+func (rw *Writer) Write(data []byte) (int, error) {
+	return len(data), rw.WriteOutput(time.Since(rw.start).Seconds(), data)
+}
+
+func (rw *Writer) WriteOutput(t float64, data []byte) error {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	data = append(rw.pending, data...)
+	n := completeUTF8(data)
+	rw.pending = append([]byte(nil), data[n:]...)
+	if n == 0 {
+		return nil
+	}
+	return rw.encoder.Encode(Event{Time: t, Type: EOutput, Data: string(data[:n])})
+}
+
+func (rw *Writer) WriteInput(t float64, data []byte) error {
+	return rw.WriteEvent(Event{Time: t, Type: EInput, Data: string(data)})
+}
+
+// Record a resize at the current time
+func (rw *Writer) Resize(cols, rows int) error {
+	return rw.WriteResize(time.Since(rw.start).Seconds(), cols, rows)
+}
+
+func (rw *Writer) WriteResize(t float64, cols, rows int) error {
+	return rw.WriteEvent(Event{Time: t, Type: EResize, Data: fmt.Sprintf("%dx%d", cols, rows)})
+}
+
+func (rw *Writer) WriteEvent(e Event) error {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	return rw.encoder.Encode(e)
+}
+
+// Write out any pending partial character
+func (rw *Writer) Flush() error {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	err := rw.encoder.Encode(Event{Time: time.Since(rw.start).Seconds(), Type: EOutput, Data: string(rw.pending)})
+	rw.pending = nil
+	return err
+}
+
+// Flush and close the underlying writer if it's a Closer
+func (rw *Writer) Close() error {
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	if c, ok := rw.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Returns the length of the longest prefix of data that doesn't end in the middle of a utf-8 sequence
+func completeUTF8(data []byte) int {
+	// a utf-8 sequence is at most 4 bytes, so only the last 3 bytes could be an incomplete one
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+// *** Reader ***
+
+type Reader struct {
+	header  Header
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Empty recording")
+	}
+
+	header := Header{}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, fmt.Errorf("Failed to read recording header: %s", err)
+	}
+	if header.Version != Version {
+		return nil, fmt.Errorf("Unsupported recording version: %d", header.Version)
+	}
+	return &Reader{header: header, scanner: scanner, line: 1}, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Returns the next event, or io.EOF at the end of the recording
+func (r *Reader) Next() (Event, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" {
+			continue
+		}
+		e := Event{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return e, fmt.Errorf("Failed to read event at line %d: %s", r.line, err)
+		}
+		return e, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// Call fn for each remaining event
+func (r *Reader) Each(fn func(Event) error) error {
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
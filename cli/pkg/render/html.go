@@ -0,0 +1,137 @@
+package render
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/qnkhuat/termishare/pkg/recording"
+	"github.com/qnkhuat/termishare/pkg/vt"
+)
+
+// Render snapshots of the screen at the given times (in seconds) to a static HTML page
+// With no times, only the final screen is rendered
+func HTML(r *recording.Reader, w io.Writer, at []float64, opts Options) error {
+	at = append([]float64(nil), at...)
+	sort.Float64s(at)
+
+	header := r.Header()
+	var frames []frame
+	// what the screen looks like before anything is written
+	prev := snapshot(vt.New(orDefault(header.Width, defaultCols), orDefault(header.Height, defaultRows)), 0)
+	i := 0
+	err := play(r, 0, func(screen *vt.Screen, t float64) error {
+		for ; i < len(at) && at[i] < t; i++ {
+			frames = append(frames, withTime(prev, at[i]))
+		}
+		prev = snapshot(screen, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for ; i < len(at); i++ {
+		frames = append(frames, withTime(prev, at[i]))
+	}
+	if len(at) == 0 {
+		frames = append(frames, prev)
+	}
+
+	bw := bufio.NewWriter(w)
+	ew := &errWriter{w: bw}
+	title := header.Title
+	if title == "" {
+		title = "termishare recording"
+	}
+	ew.printf("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>\n", html.EscapeString(title))
+	ew.printf("body{background:#fff;font-family:sans-serif}\n")
+	ew.printf("figure{margin:1em 0}\n")
+	ew.printf("pre.term{display:inline-block;margin:0;padding:.5em;background:%s;color:%s;font-size:%dpx;line-height:1.2;"+
+		"font-family:Menlo,Monaco,Consolas,'Liberation Mono','DejaVu Sans Mono',monospace}\n", defaultBg, defaultFg, opts.fontSize())
+	ew.printf(".b{font-weight:bold}.f{opacity:.6}.i{font-style:italic}.u{text-decoration:underline}.s{text-decoration:line-through}.u.s{text-decoration:underline line-through}\n")
+	ew.printf(".cur{outline:1px solid %s}\n", defaultFg)
+	ew.printf("</style>\n</head>\n<body>\n")
+	for _, f := range frames {
+		ew.printf("<figure>\n<figcaption>%s</figcaption>\n<pre class=\"term\">", formatTime(f.time))
+		writeHTMLFrame(ew, f)
+		ew.printf("</pre>\n</figure>\n")
+	}
+	ew.printf("</body>\n</html>\n")
+
+	if ew.err != nil {
+		return ew.err
+	}
+	return bw.Flush()
+}
+
+func writeHTMLFrame(ew *errWriter, f frame) {
+	for y, line := range f.lines {
+		if y > 0 {
+			ew.printf("\n")
+		}
+		lineRuns := runs(line)
+		// drop trailing blanks that would render the same as nothing
+		if n := len(lineRuns); n > 0 && lineRuns[n-1].style == (style{fg: defaultFg}) && !(f.cursor && y == f.cursorY) {
+			lineRuns[n-1].text = strings.TrimRight(lineRuns[n-1].text, " ")
+		}
+		for _, r := range lineRuns {
+			// split the run around the cursor so it can be marked
+			if f.cursor && y == f.cursorY && f.cursorX >= r.x && f.cursorX < r.x+r.width {
+				text := []rune(r.text)
+				// runs only lose characters for wide chars, fall back to not marking the cursor then
+				if len(text) == r.width {
+					offset := f.cursorX - r.x
+					writeSpan(ew, r.style, string(text[:offset]), "")
+					writeSpan(ew, r.style, string(text[offset:offset+1]), "cur")
+					writeSpan(ew, r.style, string(text[offset+1:]), "")
+					continue
+				}
+			}
+			writeSpan(ew, r.style, r.text, "")
+		}
+	}
+}
+
+func writeSpan(ew *errWriter, s style, text string, extraClass string) {
+	if text == "" {
+		return
+	}
+	css := []string{}
+	if s.fg != defaultFg {
+		css = append(css, "color:"+s.fg)
+	}
+	if s.bg != "" {
+		css = append(css, "background:"+s.bg)
+	}
+	class := strings.TrimPrefix(classAttr(s.attr), ` class="`)
+	class = strings.TrimSuffix(class, `"`)
+	if extraClass != "" {
+		class = strings.TrimSpace(class + " " + extraClass)
+	}
+
+	if len(css) == 0 && class == "" {
+		ew.printf("%s", html.EscapeString(text))
+		return
+	}
+	ew.printf("<span")
+	if class != "" {
+		ew.printf(` class="%s"`, class)
+	}
+	if len(css) > 0 {
+		ew.printf(` style="%s"`, strings.Join(css, ";"))
+	}
+	ew.printf(">%s</span>", html.EscapeString(text))
+}
+
+func withTime(f frame, t float64) frame {
+	f.time = t
+	return f
+}
+
+func formatTime(t float64) string {
+	minutes := int(t) / 60
+	return fmt.Sprintf("%02d:%06.3f", minutes, t-float64(minutes*60))
+}
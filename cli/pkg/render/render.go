@@ -0,0 +1,224 @@
+/*
+Render recordings without a browser or a JS player
+SVG renders an animated, self-contained image of the whole recording
+HTML renders static snapshots of chosen moments
+*/
+package render
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/qnkhuat/termishare/pkg/recording"
+	"github.com/qnkhuat/termishare/pkg/vt"
+)
+
+const (
+	// output closer than this is merged into one frame
+	minFrameInterval = 1.0 / 30
+
+	defaultCols = 80
+	defaultRows = 24
+
+	defaultFg = "#d0d0d0"
+	defaultBg = "#1d1f21"
+)
+
+type Options struct {
+	// pauses longer than this (in seconds) are shortened to it, 0 keeps them as is
+	IdleLimit float64
+	FontSize  int
+	// for SVG: how long the last frame stays before the animation loops, in seconds
+	EndPause float64
+}
+
+func (o Options) fontSize() int {
+	if o.FontSize <= 0 {
+		return 14
+	}
+	return o.FontSize
+}
+
+type frame struct {
+	time    float64
+	lines   [][]vt.Cell
+	cursorX int
+	cursorY int
+	cursor  bool
+}
+
+func snapshot(screen *vt.Screen, t float64) frame {
+	_, rows := screen.Size()
+	f := frame{time: t, lines: make([][]vt.Cell, rows)}
+	for y := 0; y < rows; y++ {
+		f.lines[y] = screen.Line(y)
+	}
+	f.cursorX, f.cursorY, f.cursor = screen.Cursor()
+	return f
+}
+
+func (f frame) equal(o frame) bool {
+	if len(f.lines) != len(o.lines) || f.cursorX != o.cursorX || f.cursorY != o.cursorY || f.cursor != o.cursor {
+		return false
+	}
+	for y := range f.lines {
+		if len(f.lines[y]) != len(o.lines[y]) {
+			return false
+		}
+		for x := range f.lines[y] {
+			if f.lines[y][x] != o.lines[y][x] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Play the recording on a virtual screen and call fn with the screen state after each group of events
+// Event times passed to fn have idle pauses shortened according to idleLimit
+func play(r *recording.Reader, idleLimit float64, fn func(screen *vt.Screen, t float64) error) error {
+	header := r.Header()
+	screen := vt.New(orDefault(header.Width, defaultCols), orDefault(header.Height, defaultRows))
+
+	var last, shift float64
+	pending := false
+	err := r.Each(func(e recording.Event) error {
+		if e.Type != recording.EOutput && e.Type != recording.EResize {
+			return nil
+		}
+
+		if idleLimit > 0 && e.Time-shift-last > idleLimit {
+			shift = e.Time - last - idleLimit
+		}
+		t := e.Time - shift
+
+		if pending && t-last >= minFrameInterval {
+			if err := fn(screen, last); err != nil {
+				return err
+			}
+			pending = false
+		}
+
+		switch e.Type {
+		case recording.EOutput:
+			screen.Write([]byte(e.Data))
+		case recording.EResize:
+			if cols, rows, err := e.Size(); err == nil {
+				screen.Resize(cols, rows)
+			}
+		}
+		if !pending {
+			last = t
+		}
+		pending = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if pending {
+		return fn(screen, last)
+	}
+	return nil
+}
+
+// *** Colors ***
+
+type style struct {
+	fg, bg string
+	attr   vt.Attr
+}
+
+func cellStyle(c vt.Cell) style {
+	fg := color(c.Fg, defaultFg)
+	bg := color(c.Bg, "")
+	// bold text with one of the 8 basic colors uses the bright variant, like most terminals
+	if c.Attr&vt.AttrBold != 0 && c.Fg >= 0 && c.Fg < 8 {
+		fg = color(c.Fg+8, defaultFg)
+	}
+	if c.Attr&vt.AttrReverse != 0 {
+		if bg == "" {
+			bg = defaultBg
+		}
+		fg, bg = bg, fg
+	}
+	if c.Attr&vt.AttrHidden != 0 {
+		fg = bg
+		if fg == "" {
+			fg = defaultBg
+		}
+	}
+	return style{fg: fg, bg: bg, attr: c.Attr &^ (vt.AttrReverse | vt.AttrHidden)}
+}
+
+// Returns the css color of c, or def for the default color
+func color(c vt.Color, def string) string {
+	switch {
+	case c == vt.DefaultColor:
+		return def
+	case c.IsRGB():
+		r, g, b := c.Components()
+		return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+	case c < 16:
+		return basicColors[c]
+	case c < 232:
+		// 6x6x6 color cube
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+		i := int(c) - 16
+		return fmt.Sprintf("#%02x%02x%02x", levels[i/36], levels[(i/6)%6], levels[i%6])
+	case c < 256:
+		v := 8 + (int(c)-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+	return def
+}
+
+var basicColors = [16]string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+// A run of cells on one line that share the same style
+type run struct {
+	x     int
+	width int
+	text  string
+	style style
+}
+
+func runs(line []vt.Cell) []run {
+	var result []run
+	for x := 0; x < len(line); {
+		s := cellStyle(line[x])
+		r := run{x: x, style: s}
+		text := []rune{}
+		for ; x < len(line) && cellStyle(line[x]) == s; x++ {
+			if line[x].Char != 0 {
+				text = append(text, line[x].Char)
+			}
+			r.width++
+		}
+		r.text = string(text)
+		result = append(result, r)
+	}
+	return result
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
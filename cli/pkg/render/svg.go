@@ -0,0 +1,137 @@
+package render
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/qnkhuat/termishare/pkg/recording"
+	"github.com/qnkhuat/termishare/pkg/vt"
+)
+
+// Render the recording to an animated SVG
+// All frames are stacked vertically and a CSS animation slides them through the view, so it plays anywhere an image does
+func SVG(r *recording.Reader, w io.Writer, opts Options) error {
+	var frames []frame
+	err := play(r, opts.IdleLimit, func(screen *vt.Screen, t float64) error {
+		f := snapshot(screen, t)
+		if len(frames) == 0 || !frames[len(frames)-1].equal(f) {
+			frames = append(frames, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("Nothing to render")
+	}
+
+	// the view is as large as the largest frame
+	cols, rows := 0, 0
+	for _, f := range frames {
+		if len(f.lines) > rows {
+			rows = len(f.lines)
+		}
+		if len(f.lines) > 0 && len(f.lines[0]) > cols {
+			cols = len(f.lines[0])
+		}
+	}
+
+	fontSize := float64(opts.fontSize())
+	cellW, cellH := fontSize*0.6, fontSize*1.2
+	width, height := float64(cols)*cellW, float64(rows)*cellH
+	duration := frames[len(frames)-1].time + opts.EndPause
+	if opts.EndPause <= 0 {
+		duration += 1
+	}
+
+	bw := bufio.NewWriter(w)
+	ew := &errWriter{w: bw}
+	ew.printf(`<svg xmlns="http://www.w3.org/2000/svg" width="%.1f" height="%.1f" viewBox="0 0 %.1f %.1f">`+"\n",
+		width, height, width, height)
+	ew.printf("<style>\n")
+	ew.printf("text{font-family:Menlo,Monaco,Consolas,'Liberation Mono','DejaVu Sans Mono',monospace;font-size:%.0fpx;white-space:pre;dominant-baseline:text-before-edge}\n", fontSize)
+	ew.printf(".b{font-weight:bold}.f{opacity:.6}.i{font-style:italic}.u{text-decoration:underline}.s{text-decoration:line-through}.u.s{text-decoration:underline line-through}\n")
+	if len(frames) > 1 {
+		ew.printf(".film{animation:play %.3fs step-end infinite}\n", duration)
+		ew.printf("@keyframes play{\n")
+		for i, f := range frames {
+			pct := f.time / duration * 100
+			if i == 0 {
+				pct = 0
+			}
+			ew.printf("%.3f%%{transform:translateY(%.1fpx)}\n", pct, -float64(i)*height)
+		}
+		ew.printf("}\n")
+	}
+	ew.printf("</style>\n")
+	ew.printf(`<rect width="100%%" height="100%%" fill="%s"/>`+"\n", defaultBg)
+	ew.printf(`<g class="film">` + "\n")
+	for i, f := range frames {
+		ew.printf(`<g transform="translate(0 %.1f)">`+"\n", float64(i)*height)
+		writeSVGFrame(ew, f, cellW, cellH)
+		ew.printf("</g>\n")
+	}
+	ew.printf("</g>\n</svg>\n")
+
+	if ew.err != nil {
+		return ew.err
+	}
+	return bw.Flush()
+}
+
+func writeSVGFrame(ew *errWriter, f frame, cellW, cellH float64) {
+	for y, line := range f.lines {
+		lineRuns := runs(line)
+		for _, r := range lineRuns {
+			if r.style.bg != "" {
+				ew.printf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n",
+					float64(r.x)*cellW, float64(y)*cellH, float64(r.width)*cellW, cellH, r.style.bg)
+			}
+		}
+		for _, r := range lineRuns {
+			text := r.text
+			if r.style.attr&(vt.AttrUnderline|vt.AttrStrike) == 0 {
+				text = strings.TrimRight(text, " ")
+			}
+			if text == "" {
+				continue
+			}
+			ew.printf(`<text x="%.1f" y="%.1f" fill="%s"%s>`, float64(r.x)*cellW, float64(y)*cellH, r.style.fg, classAttr(r.style.attr))
+			xml.EscapeText(writerFunc(ew.printf), []byte(text))
+			ew.printf("</text>\n")
+		}
+	}
+
+	if f.cursor && f.cursorY < len(f.lines) {
+		ew.printf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" opacity=".7"/>`+"\n",
+			float64(f.cursorX)*cellW, float64(f.cursorY)*cellH, cellW, cellH, defaultFg)
+	}
+}
+
+func classAttr(attr vt.Attr) string {
+	classes := []string{}
+	for _, c := range []struct {
+		attr  vt.Attr
+		class string
+	}{{vt.AttrBold, "b"}, {vt.AttrFaint, "f"}, {vt.AttrItalic, "i"}, {vt.AttrUnderline, "u"}, {vt.AttrStrike, "s"}} {
+		if attr&c.attr != 0 {
+			classes = append(classes, c.class)
+		}
+	}
+	if len(classes) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(` class="%s"`, strings.Join(classes, " "))
+}
+
+// adapts printf to an io.Writer for xml.EscapeText
+type writerFunc func(format string, args ...interface{})
+
+func (fn writerFunc) Write(p []byte) (int, error) {
+	fn("%s", p)
+	return len(p), nil
+}
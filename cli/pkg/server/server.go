@@ -0,0 +1,225 @@
+// A signaling server compatible with the termishare jar, without the web client
+// Like the jar it's as dumb as possible: it broadcasts the messages of a connection to the others in its room,
+// it doesn't know who is the host and who are clients
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultMaxRooms       = 1000
+	DefaultMaxRoomSize    = 32
+	DefaultMaxMessageSize = 64 * 1024
+
+	// messages waiting to be sent to a connection, it's closed if it can't keep up
+	sendBufferSize = 256
+	writeTimeout   = 10 * time.Second
+	// connections that don't answer pings for this long are closed
+	pongTimeout  = 60 * time.Second
+	pingInterval = pongTimeout / 2
+)
+
+type Options struct {
+	// rooms at the same time, DefaultMaxRooms if 0
+	MaxRooms int
+	// connections in a room, DefaultMaxRoomSize if 0
+	MaxRoomSize int
+	// larger messages close the connection, DefaultMaxMessageSize if 0
+	MaxMessageSize int64
+	// path the server is served under when a reverse proxy doesn't strip it, e.g. /termishare
+	BasePath string
+}
+
+type Server struct {
+	opts     Options
+	upgrader websocket.Upgrader
+	mux      *http.ServeMux
+
+	lock  sync.Mutex
+	rooms map[string]map[*conn]bool
+}
+
+type conn struct {
+	ws   *websocket.Conn
+	send chan []byte
+	// closed once the connection left its room
+	done      chan bool
+	closeOnce sync.Once
+}
+
+func New(opts Options) *Server {
+	if opts.MaxRooms <= 0 {
+		opts.MaxRooms = DefaultMaxRooms
+	}
+	if opts.MaxRoomSize <= 0 {
+		opts.MaxRoomSize = DefaultMaxRoomSize
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	opts.BasePath = strings.TrimRight(opts.BasePath, "/")
+	if opts.BasePath != "" && !strings.HasPrefix(opts.BasePath, "/") {
+		opts.BasePath = "/" + opts.BasePath
+	}
+
+	s := &Server{
+		opts:  opts,
+		rooms: make(map[string]map[*conn]bool),
+		upgrader: websocket.Upgrader{
+			// the web client may be served from anywhere
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		mux: http.NewServeMux(),
+	}
+	s.mux.HandleFunc(opts.BasePath+"/api/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fine"))
+	})
+	s.mux.HandleFunc(opts.BasePath+"/ws/", s.handleWebSocket)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Number of rooms with someone in it
+func (s *Server) Rooms() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.rooms)
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	roomID := strings.TrimPrefix(r.URL.Path, s.opts.BasePath+"/ws/")
+	if roomID == "" || strings.Contains(roomID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	c := &conn{send: make(chan []byte, sendBufferSize), done: make(chan bool)}
+	if err := s.join(roomID, c); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %s", err)
+		s.leave(roomID, c)
+		return
+	}
+	c.ws = ws
+	log.Printf("Joined room %s from %s", roomID, r.RemoteAddr)
+
+	go c.writeLoop()
+	s.readLoop(roomID, c)
+	s.leave(roomID, c)
+	log.Printf("Left room %s from %s", roomID, r.RemoteAddr)
+}
+
+func (s *Server) join(roomID string, c *conn) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	room, ok := s.rooms[roomID]
+	if !ok {
+		if len(s.rooms) >= s.opts.MaxRooms {
+			return fmt.Errorf("Too many rooms")
+		}
+		room = make(map[*conn]bool)
+		s.rooms[roomID] = room
+	}
+	if len(room) >= s.opts.MaxRoomSize {
+		return fmt.Errorf("Room is full")
+	}
+	room[c] = true
+	return nil
+}
+
+func (s *Server) leave(roomID string, c *conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if room, ok := s.rooms[roomID]; ok {
+		delete(room, c)
+		if len(room) == 0 {
+			delete(s.rooms, roomID)
+		}
+	}
+	c.close()
+}
+
+func (s *Server) readLoop(roomID string, c *conn) {
+	c.ws.SetReadLimit(s.opts.MaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	for {
+		msgType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				log.Printf("Failed to read message: %s", err)
+			}
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		s.broadcast(roomID, c, data)
+	}
+}
+
+// Send data to everyone in the room except from
+func (s *Server) broadcast(roomID string, from *conn, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.rooms[roomID] {
+		if c == from {
+			continue
+		}
+		select {
+		case c.send <- data:
+		default:
+			log.Printf("Closing a connection of room %s that can't keep up", roomID)
+			c.close()
+		}
+	}
+}
+
+func (c *conn) writeLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	defer c.ws.Close()
+	for {
+		select {
+		case data := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Failed to send message: %s", err)
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case <-c.done:
+			c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dial(t *testing.T, ts *httptest.Server, path string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+	ws, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if ws != nil {
+		t.Cleanup(func() { ws.Close() })
+	}
+	return ws, resp, err
+}
+
+func mustDial(t *testing.T, ts *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := dial(t, ts, path)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %s", path, err)
+	}
+	return ws
+}
+
+// Wait until the server counts n rooms, connections join their room before the handshake ends
+func waitRooms(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Rooms() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d rooms, got %d", n, s.Rooms())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ts := httptest.NewServer(New(Options{}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "fine" {
+		t.Fatalf("Expected 200 fine, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	ts := httptest.NewServer(New(Options{BasePath: "termishare/"}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/termishare/api/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 under the base path, got %d", resp.StatusCode)
+	}
+	if _, _, err := dial(t, ts, "/ws/room"); err == nil {
+		t.Fatal("Expected /ws/ outside of the base path to be rejected")
+	}
+	mustDial(t, ts, "/termishare/ws/room")
+}
+
+func TestBroadcastExcludesSender(t *testing.T) {
+	s := New(Options{})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	a := mustDial(t, ts, "/ws/room")
+	b := mustDial(t, ts, "/ws/room")
+	other := mustDial(t, ts, "/ws/other")
+	waitRooms(t, s, 2)
+
+	if err := a.WriteMessage(websocket.TextMessage, []byte(`{"Type":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := b.ReadMessage()
+	if err != nil {
+		t.Fatalf("Expected the message in the same room: %s", err)
+	}
+	if string(data) != `{"Type":"hello"}` {
+		t.Fatalf("Unexpected message: %s", data)
+	}
+
+	// neither the sender nor another room get it
+	for name, ws := range map[string]*websocket.Conn{"sender": a, "other room": other} {
+		ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, data, err := ws.ReadMessage(); err == nil {
+			t.Fatalf("The %s got the message: %s", name, data)
+		}
+	}
+}
+
+func TestMaxRoomSize(t *testing.T) {
+	s := New(Options{MaxRoomSize: 2})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	mustDial(t, ts, "/ws/room")
+	mustDial(t, ts, "/ws/room")
+	_, resp, err := dial(t, ts, "/ws/room")
+	if err == nil {
+		t.Fatal("Expected a full room to be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %v", resp)
+	}
+}
+
+func TestMaxRooms(t *testing.T) {
+	s := New(Options{MaxRooms: 1})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	first := mustDial(t, ts, "/ws/first")
+	_, resp, err := dial(t, ts, "/ws/second")
+	if err == nil {
+		t.Fatal("Expected a new room over the limit to be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %v", resp)
+	}
+	// joining an existing room is fine, and rooms are freed once empty
+	again := mustDial(t, ts, "/ws/first")
+	first.Close()
+	again.Close()
+	waitRooms(t, s, 0)
+	mustDial(t, ts, "/ws/second")
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	s := New(Options{MaxMessageSize: 16})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	a := mustDial(t, ts, "/ws/room")
+	b := mustDial(t, ts, "/ws/room")
+	waitRooms(t, s, 1)
+
+	if err := a.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17))); err != nil {
+		t.Fatal(err)
+	}
+	a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := a.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("Expected the connection to be closed for a too large message, got %v", err)
+	}
+
+	// and it isn't broadcast
+	b.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := b.ReadMessage(); err == nil {
+		t.Fatalf("The too large message was broadcast: %s", data)
+	}
+}
@@ -0,0 +1,169 @@
+// Escape key handling and the command menu of RemoteClient
+// Like ssh's ~, pressing the escape key followed by a command key runs a client command instead of sending the keys
+package termishare
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const DefaultEscapeKey byte = 0x18 // Ctrl-x
+
+// Parse an escape key like "^x", "ctrl-x", "C-]" or a single character like "~"
+func ParseEscapeKey(s string) (byte, error) {
+	lower := strings.ToLower(s)
+	for _, prefix := range []string{"^", "ctrl-", "ctrl+", "c-"} {
+		if strings.HasPrefix(lower, prefix) && len(lower) == len(prefix)+1 {
+			c := lower[len(prefix)]
+			switch {
+			case c >= 'a' && c <= 'z':
+				return c - 'a' + 1, nil
+			case c >= '@' && c <= '_':
+				return c - '@', nil
+			}
+		}
+	}
+
+	if len(s) == 1 && s[0] < 0x80 {
+		return s[0], nil
+	}
+	return 0, fmt.Errorf("Invalid escape key: %q", s)
+}
+
+// Human readable name of a key, "Ctrl-x" for control characters
+func KeyName(key byte) string {
+	switch {
+	case key >= 1 && key <= 26:
+		return fmt.Sprintf("Ctrl-%c", 'a'+key-1)
+	case key < 0x20:
+		return fmt.Sprintf("Ctrl-%c", '@'+key)
+	case key == 0x7f:
+		return "Del"
+	}
+	return string(key)
+}
+
+func (rc *RemoteClient) SetEscapeKey(key byte) {
+	rc.escapeKey = key
+}
+
+func (rc *RemoteClient) escapeHelp() string {
+	key := KeyName(rc.escapeKey)
+	help := fmt.Sprintf("%s then: . detach | r refresh | i info | n network diagnostics | v toggle read-only | %s send %s | ? help", key, key, key)
+	if rc.viewportEnabled() {
+		help += " | h/j/k/l pan | f follow cursor"
+	}
+	return help
+}
+
+// Handle a key typed by the user, returns the bytes to send to the host
+func (rc *RemoteClient) handleKey(key byte) []byte {
+	if rc.isPanning() {
+		// the key that ends panning is dropped too, it was most likely meant for panning
+		rc.handlePanKey(key)
+		return nil
+	}
+
+	if !rc.escaping {
+		if key == rc.escapeKey {
+			rc.escaping = true
+			return nil
+		}
+		return []byte{key}
+	}
+
+	rc.escaping = false
+	switch key {
+	case rc.escapeKey:
+		return []byte{key}
+
+	case '.', 'd':
+		log.Printf("Escape key detected. Exiting")
+		go rc.Stop("Disconnected!")
+
+	case 'r':
+		if err := rc.requestRemoteRefresh(); err != nil {
+			log.Printf("Failed to request refresh: %s", err)
+			rc.showStatus(fmt.Sprintf("Failed to refresh: %s", err))
+		}
+
+	case 'i':
+		rc.showStatus(rc.connectionInfo())
+
+	case 'n':
+		rc.showStatus("Measuring...")
+		go func() {
+			rc.showStatus(rc.Diagnostics().String())
+		}()
+
+	case 'v':
+		if rc.viewOnly {
+			rc.showStatus("View-only: you joined as a viewer, your keys are never sent to the host")
+			break
+		}
+		rc.readOnly = !rc.readOnly
+		if rc.readOnly {
+			rc.showStatus("Read-only: your keys are not sent to the host")
+		} else {
+			rc.showStatus("Read-write: your keys are sent to the host")
+		}
+
+	case '?':
+		rc.showStatus(rc.escapeHelp())
+
+	case 'h', 'j', 'k', 'l', 'f':
+		if !rc.viewportEnabled() {
+			return []byte{rc.escapeKey, key}
+		}
+		rc.view.lock.Lock()
+		rc.view.panning = key != 'f'
+		rc.view.lock.Unlock()
+		rc.handlePanKey(key)
+
+	default:
+		// not a command, send both keys so nothing typed is lost
+		return []byte{rc.escapeKey, key}
+	}
+	return nil
+}
+
+func (rc *RemoteClient) connectionInfo() string {
+	state := "not connected"
+	if rc.getRelay() != nil {
+		state = "relayed through the signaling server"
+	} else if peerConn := rc.getPeerConn(); peerConn != nil {
+		state = peerConn.ConnectionState().String()
+	}
+	mode := "read-write"
+	if rc.viewOnly {
+		mode = "view-only"
+	} else if rc.readOnly {
+		mode = "read-only"
+	}
+	return fmt.Sprintf("%s | session %s | %s | %s | host %dx%d, you %dx%d",
+		rc.server, rc.sessionID, state, mode,
+		rc.winSizes.remoteCols, rc.winSizes.remoteRows, rc.winSizes.thisCols, rc.winSizes.thisRows)
+}
+
+// Show a message on the last line of the terminal, it stays until the host redraws that line
+func (rc *RemoteClient) showStatus(msg string) {
+	if rc.headless() {
+		log.Printf("Status: %s", msg)
+		return
+	}
+	if rc.viewportEnabled() {
+		rc.showViewportStatus(msg)
+		return
+	}
+	rows := rc.winSizes.thisRows
+	if rows == 0 {
+		rows = 1
+	}
+	if cols := int(rc.winSizes.thisCols); cols > 0 && len(msg) > cols {
+		msg = msg[:cols]
+	}
+	// save cursor, go to the last line, print in reverse video, restore cursor
+	fmt.Fprintf(os.Stdout, "\x1b7\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m\x1b8", rows, msg)
+}
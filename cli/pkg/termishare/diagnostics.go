@@ -0,0 +1,164 @@
+package termishare
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/qnkhuat/termishare/pkg/message"
+)
+
+// how long to wait for the pong when measuring the round trip time
+const rttTimeout = 2 * time.Second
+
+// What a peer connection goes through, to tell why a session is slow
+type Diagnostics struct {
+	State string
+
+	// the selected candidate pair, types are host, srflx, prflx or relay
+	LocalCandidateType  string
+	RemoteCandidateType string
+	LocalAddress        string
+	RemoteAddress       string
+	// udp or tcp
+	Protocol string
+	// how we reach the TURN server when relayed: udp, tcp or tls
+	RelayProtocol string
+
+	// 0 if it couldn't be measured
+	RTT           time.Duration
+	BytesSent     uint64
+	BytesReceived uint64
+
+	DTLSState string
+	SCTPState string
+
+	// the channels are relayed through the signaling server, see relay.go
+	SignalingRelay bool
+}
+
+// Whether the connection goes through a TURN server
+func (d Diagnostics) Relayed() bool {
+	return d.LocalCandidateType == webrtc.ICECandidateTypeRelay.String() || d.RemoteCandidateType == webrtc.ICECandidateTypeRelay.String()
+}
+
+func (d Diagnostics) String() string {
+	path := "no candidate pair selected"
+	if d.LocalCandidateType != "" {
+		path = fmt.Sprintf("%s/%s -> %s/%s", d.LocalCandidateType, d.Protocol, d.RemoteCandidateType, d.Protocol)
+		if d.RelayProtocol != "" {
+			path += fmt.Sprintf(" (turn over %s)", d.RelayProtocol)
+		}
+	}
+	rtt := "rtt unknown"
+	if d.RTT >= time.Millisecond {
+		rtt = fmt.Sprintf("rtt %dms", d.RTT.Milliseconds())
+	} else if d.RTT > 0 {
+		rtt = "rtt <1ms"
+	}
+	if d.SignalingRelay {
+		return fmt.Sprintf("%s | through the signaling server | %s", d.State, rtt)
+	}
+	return fmt.Sprintf("%s | %s | %s | in %s out %s | dtls %s, sctp %s",
+		d.State, path, rtt, formatBytes(d.BytesReceived), formatBytes(d.BytesSent), d.DTLSState, d.SCTPState)
+}
+
+// Read the diagnostics of a peer connection from pion's stats, without the measured round trip time
+func collectDiagnostics(peerConn *webrtc.PeerConnection) Diagnostics {
+	if peerConn == nil {
+		return Diagnostics{State: "not connected"}
+	}
+
+	d := Diagnostics{State: peerConn.ConnectionState().String()}
+	report := peerConn.GetStats()
+	if stats, ok := report["iceTransport"].(webrtc.TransportStats); ok {
+		d.BytesSent = stats.BytesSent
+		d.BytesReceived = stats.BytesReceived
+	}
+
+	sctp := peerConn.SCTP()
+	if sctp == nil {
+		return d
+	}
+	d.SCTPState = sctp.State().String()
+	dtls := sctp.Transport()
+	if dtls == nil {
+		return d
+	}
+	d.DTLSState = dtls.State().String()
+
+	pair, err := dtls.ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return d
+	}
+	d.LocalCandidateType = pair.Local.Typ.String()
+	d.RemoteCandidateType = pair.Remote.Typ.String()
+	d.LocalAddress = fmt.Sprintf("%s:%d", pair.Local.Address, pair.Local.Port)
+	d.RemoteAddress = fmt.Sprintf("%s:%d", pair.Remote.Address, pair.Remote.Port)
+	d.Protocol = pair.Local.Protocol.String()
+	if stats, ok := report.GetICECandidateStats(pair.Local); ok {
+		d.RelayProtocol = stats.RelayProtocol
+	}
+	if stats, ok := report.GetICECandidatePairStats(pair); ok {
+		d.RTT = time.Duration(stats.CurrentRoundTripTime * float64(time.Second))
+	}
+	return d
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// Measures the round trip time of a config channel with RTTPing/RTTPong messages
+type rttProbe struct {
+	lock    sync.Mutex
+	waiting map[string]chan bool
+}
+
+func (p *rttProbe) measure(sendConfig func(message.Wrapper) error) (time.Duration, error) {
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	answered := make(chan bool, 1)
+	p.lock.Lock()
+	if p.waiting == nil {
+		p.waiting = make(map[string]chan bool)
+	}
+	p.waiting[id] = answered
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.waiting, id)
+		p.lock.Unlock()
+	}()
+
+	start := time.Now()
+	if err := sendConfig(message.Wrapper{Type: message.TRTTPing, Data: id}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-answered:
+		return time.Since(start), nil
+	case <-time.After(rttTimeout):
+		return 0, fmt.Errorf("No answer to ping")
+	}
+}
+
+// Handle a pong received on the config channel
+func (p *rttProbe) pong(msg message.Wrapper) {
+	id, _ := msg.Data.(string)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if answered, ok := p.waiting[id]; ok {
+		select {
+		case answered <- true:
+		default:
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package termishare
+
+type EventType string
+
+const (
+	// events of a Session
+
+	// the session requires a passcode, AskPasscode is going to be called
+	EventPasscodeRequired EventType = "PasscodeRequired"
+	EventAuthenticated    EventType = "Authenticated"
+	// the host's terminal has a new size
+	EventWinsize      EventType = "Winsize"
+	EventReconnecting EventType = "Reconnecting"
+	EventReconnected  EventType = "Reconnected"
+	// the peer connection couldn't connect, the session is relayed through the signaling server, see relay.go
+	EventRelayed EventType = "Relayed"
+	// the session is over, Reason tells why
+	EventDisconnected EventType = "Disconnected"
+
+	// events of a Termishare host
+
+	EventClientJoined        EventType = "ClientJoined"
+	EventClientAuthenticated EventType = "ClientAuthenticated"
+	// the client declared it only watches
+	EventClientViewer EventType = "ClientViewer"
+	EventClientLeft   EventType = "ClientLeft"
+	// the client couldn't connect directly or through TURN, its channels are relayed through the signaling server
+	EventClientRelayed EventType = "ClientRelayed"
+	// the connection to the signaling server is lost, clients already in stay connected but new ones can't join
+	// until EventSignalingRestored
+	EventSignalingLost     EventType = "SignalingLost"
+	EventSignalingRestored EventType = "SignalingRestored"
+	// failed to handle a message, from ClientID if set
+	EventError EventType = "Error"
+)
+
+type Event struct {
+	Type EventType
+	// the host's terminal size for EventWinsize
+	Cols int
+	Rows int
+	// why the session ended for EventDisconnected, "Incorrect passcode" for EventPasscodeRequired after a wrong one
+	Reason string
+	// the client the host event is about
+	ClientID string
+	Err      error
+}
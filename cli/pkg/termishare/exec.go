@@ -0,0 +1,182 @@
+// Exec mode of RemoteClient: run one command in a shared session from a script, without a terminal
+package termishare
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/qnkhuat/termishare/pkg/vt"
+)
+
+const (
+	// before sending the command, wait for the host to stop sending the current screen
+	execSettleTime     = 500 * time.Millisecond
+	execMaxSettleTime  = 3 * time.Second
+	defaultExecTimeout = 30 * time.Second
+)
+
+var (
+	ErrExecTimeout      = errors.New("Timed out waiting for the command")
+	ErrExecDisconnected = errors.New("Disconnected before the command finished")
+)
+
+type ExecOptions struct {
+	// sent to the host followed by enter
+	Command string
+	// the command is done when this appears in its output, the echo of the command line itself is skipped
+	// if empty, the output is collected until Timeout
+	Marker string
+	// how long to wait for the command, 30s by default. With a Marker, reaching it is an error
+	Timeout time.Duration
+	// write everything received from the host, not only the output after the command was sent
+	All bool
+	// where the output is written, stdout by default
+	Output io.Writer
+}
+
+type execSession struct {
+	lock sync.Mutex
+	opts ExecOptions
+
+	lastOutput time.Time
+	sent       bool
+	// the echo of the command line is over
+	echoed bool
+	// end of the output so far, to find a marker split across messages
+	tail  []byte
+	found chan bool
+}
+
+func (es *execSession) Write(data []byte) (int, error) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	n := len(data)
+	es.lastOutput = time.Now()
+	if es.opts.All {
+		es.opts.Output.Write(data)
+	}
+	if !es.sent {
+		return n, nil
+	}
+
+	if !es.echoed {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return n, nil
+		}
+		es.echoed = true
+		data = data[i+1:]
+	}
+	if !es.opts.All {
+		es.opts.Output.Write(data)
+	}
+
+	if marker := []byte(es.opts.Marker); len(marker) > 0 {
+		buf := append(es.tail, data...)
+		if bytes.Contains(buf, marker) {
+			select {
+			case <-es.found:
+			default:
+				close(es.found)
+			}
+		}
+		if keep := len(marker) - 1; len(buf) > keep {
+			buf = buf[len(buf)-keep:]
+		}
+		es.tail = append([]byte(nil), buf...)
+	}
+	return n, nil
+}
+
+func (es *execSession) idleFor() time.Duration {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	return time.Since(es.lastOutput)
+}
+
+func (es *execSession) markSent() {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	es.sent = true
+}
+
+// Connect to a session without a terminal, send a command and write its output to opts.Output
+// Returns ErrExecTimeout if the marker isn't found in time and ErrExecDisconnected if the connection is lost
+// Other than timeouts, why the command failed is also printed to stderr
+func (rc *RemoteClient) Exec(server string, sessionID string, opts ExecOptions) error {
+	log.Printf("Exec: %s", opts.Command)
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultExecTimeout
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	es := &execSession{opts: opts, lastOutput: time.Now(), found: make(chan bool)}
+	rc.exec = es
+	// not used to draw anything, but handlers expect a screen
+	rc.screen = vt.New(80, 24)
+
+	// the timeout also bounds connecting and joining
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	deadline := ctx.Done()
+	if err := rc.join(ctx, server, sessionID); err != nil {
+		if err == context.DeadlineExceeded {
+			rc.Stop("")
+			return ErrExecTimeout
+		}
+		return err
+	}
+	defer rc.Stop("")
+
+	// wait for the data channel to open and the current screen to be sent
+	start := time.Now()
+	for {
+		select {
+		case <-rc.done:
+			return ErrExecDisconnected
+		case <-deadline:
+			return ErrExecTimeout
+		case <-time.After(50 * time.Millisecond):
+		}
+		if !rc.dataChannelOpen() {
+			start = time.Now()
+			continue
+		}
+		if es.idleFor() >= execSettleTime || time.Since(start) >= execMaxSettleTime {
+			break
+		}
+	}
+
+	es.markSent()
+	if err := rc.sendData([]byte(opts.Command + "\r")); err != nil {
+		rc.Stop(fmt.Sprintf("Failed to send command: %s", err))
+		return rc.stopError()
+	}
+
+	select {
+	case <-es.found:
+		return nil
+	case <-rc.done:
+		return ErrExecDisconnected
+	case <-deadline:
+		if opts.Marker == "" {
+			return nil
+		}
+		return ErrExecTimeout
+	}
+}
+
+func (rc *RemoteClient) dataChannelOpen() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.relay != nil || (rc.dataChannel != nil && rc.dataChannel.ReadyState() == webrtc.DataChannelStateOpen)
+}
@@ -0,0 +1,123 @@
+package termishare
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/qnkhuat/termishare/internal/cfg"
+	"github.com/qnkhuat/termishare/pkg/message"
+)
+
+// The default STUN and TURN servers
+func DefaultICEServers() []webrtc.ICEServer {
+	servers := append([]webrtc.ICEServer{}, cfg.TERMISHARE_ICE_SERVER_STUNS...)
+	return append(servers, cfg.TERMISHARE_ICE_SERVER_TURNS...)
+}
+
+// Parse a comma separated list of urls like stun:host:3478, turn:host:3478?transport=tcp or turns:host:5349
+// username and credential are used for TURN urls, they can be set later with WithTURNCredentials
+func ParseICEURLs(urls string, username string, credential string) ([]webrtc.ICEServer, error) {
+	var servers []webrtc.ICEServer
+	for _, url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		server := webrtc.ICEServer{URLs: []string{url}}
+		if isTURN(url) {
+			server.Username = username
+			server.Credential = credential
+		} else if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "stuns:") {
+			return nil, fmt.Errorf("Invalid ICE server url: %s", url)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// Load ICE servers from a JSON file with the format of iceServers in RTCConfiguration:
+// [{"urls": ["turn:host:3478", "turns:host:5349"], "username": "user", "credential": "pass"}]
+func LoadICEServers(path string) ([]webrtc.ICEServer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []webrtc.ICEServer
+	if err := json.Unmarshal(content, &servers); err != nil {
+		return nil, fmt.Errorf("Failed to parse ICE servers in %s: %s", path, err)
+	}
+	return servers, nil
+}
+
+// Remove the TURN urls from servers
+func WithoutTURN(servers []webrtc.ICEServer) []webrtc.ICEServer {
+	var result []webrtc.ICEServer
+	for _, server := range servers {
+		var urls []string
+		for _, url := range server.URLs {
+			if !isTURN(url) {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			server.URLs = urls
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+// An error for the first TURN server without a username or a credential
+func CheckTURNCredentials(servers []webrtc.ICEServer) error {
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			if isTURN(url) && (server.Username == "" || server.Credential == nil || server.Credential == "") {
+				return fmt.Errorf("TURN server %s needs a username and a credential", url)
+			}
+		}
+	}
+	return nil
+}
+
+func isTURN(url string) bool {
+	return strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:")
+}
+
+// Servers of both lists, without the urls of b already in a
+func mergeICEServers(a, b []webrtc.ICEServer) []webrtc.ICEServer {
+	seen := map[string]bool{}
+	result := append([]webrtc.ICEServer{}, a...)
+	for _, server := range a {
+		for _, url := range server.URLs {
+			seen[url] = true
+		}
+	}
+	for _, server := range b {
+		var urls []string
+		for _, url := range server.URLs {
+			if !seen[url] {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			server.URLs = urls
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+// ICE servers the host sent with NoPasscode or Authenticated, nil if it didn't send any
+func iceServersFromMessage(msg message.Wrapper) ([]webrtc.ICEServer, error) {
+	if msg.Data == nil {
+		return nil, nil
+	}
+	var servers []webrtc.ICEServer
+	if err := message.ToStruct(msg.Data, &servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
@@ -0,0 +1,179 @@
+package termishare
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// Which candidates are gathered and shared with the other peer
+// The zero value is pion's defaults
+type ICEPolicy struct {
+	// ICETransportPolicyRelay to only connect through TURN servers
+	TransportPolicy webrtc.ICETransportPolicy
+	// only gather candidates on these network interfaces, all if empty
+	Interfaces []string
+	// only gather candidates of these types, e.g. udp4 to not use IPv6, all if empty
+	NetworkTypes []webrtc.NetworkType
+	// range of the local UDP ports, any port if 0
+	PortMin uint16
+	PortMax uint16
+	// MulticastDNSModeQueryAndGather hides local IPs behind .local names, MulticastDNSModeDisabled turns mDNS off
+	MulticastDNS ice.MulticastDNSMode
+	// never send host candidates, so local IPs aren't shown to the other peer
+	NoHostCandidates bool
+}
+
+// A webrtc API that creates peer connections following the policy
+// TURN servers over TCP and TLS are reached through proxy, see Options.Proxy
+func (p ICEPolicy) api(proxy string, servers []webrtc.ICEServer) (*webrtc.API, error) {
+	se := webrtc.SettingEngine{}
+	if proxyConfigured(proxy) {
+		se.SetICEProxyDialer(newICEProxyDialer(proxy, servers))
+	}
+	if len(p.Interfaces) > 0 {
+		se.SetInterfaceFilter(func(name string) bool {
+			for _, allowed := range p.Interfaces {
+				if name == allowed {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if len(p.NetworkTypes) > 0 {
+		se.SetNetworkTypes(p.NetworkTypes)
+	}
+	if p.PortMin != 0 || p.PortMax != 0 {
+		if err := se.SetEphemeralUDPPortRange(p.PortMin, p.PortMax); err != nil {
+			return nil, fmt.Errorf("Invalid UDP port range: %s", err)
+		}
+	}
+	if p.MulticastDNS != 0 {
+		se.SetICEMulticastDNSMode(p.MulticastDNS)
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(se)), nil
+}
+
+// Create a peer connection following the policy
+func (p ICEPolicy) newPeerConnection(config webrtc.Configuration, proxy string) (*webrtc.PeerConnection, error) {
+	api, err := p.api(proxy, config.ICEServers)
+	if err != nil {
+		return nil, err
+	}
+	config.ICETransportPolicy = p.TransportPolicy
+	return api.NewPeerConnection(config)
+}
+
+// the local address a srflx or relay candidate was gathered from, e.g. the local end of a TURN over TCP connection
+var candidateRelatedAddress = regexp.MustCompile(` raddr \S+ rport \d+`)
+
+// Whether a local candidate can be sent to the other peer
+func (p ICEPolicy) shareCandidate(candidate *webrtc.ICECandidate) bool {
+	return !(p.NoHostCandidates && candidate.Typ == webrtc.ICECandidateTypeHost)
+}
+
+// A local candidate as sent to the other peer
+func (p ICEPolicy) candidateInit(candidate *webrtc.ICECandidate) webrtc.ICECandidateInit {
+	init := candidate.ToJSON()
+	init.Candidate = p.hideLocalAddress(init.Candidate)
+	return init
+}
+
+// Without host candidates, local IPs must not show in the related address of the others either
+// It's only informational, so it's zeroed like browsers do
+func (p ICEPolicy) hideLocalAddress(candidate string) string {
+	if !p.NoHostCandidates {
+		return candidate
+	}
+	return candidateRelatedAddress.ReplaceAllString(candidate, " raddr 0.0.0.0 rport 0")
+}
+
+// Remove the candidates that can't be sent from a session description
+func (p ICEPolicy) filterSDP(sdp string) string {
+	if !p.NoHostCandidates {
+		return sdp
+	}
+	lines := strings.SplitAfter(sdp, "\n")
+	var result []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") {
+			if strings.Contains(line, " typ host") {
+				continue
+			}
+			line = p.hideLocalAddress(line)
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "")
+}
+
+// Parse a port range like 50000-50100
+func ParsePortRange(ports string) (uint16, uint16, error) {
+	parts := strings.SplitN(ports, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid port range: %s, expected min-max", ports)
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid port range: %s", ports)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+	if err != nil || max < min {
+		return 0, 0, fmt.Errorf("Invalid port range: %s", ports)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+// Parse a comma separated list of network types: udp4, udp6, tcp4 and tcp6
+func ParseNetworkTypes(types string) ([]webrtc.NetworkType, error) {
+	var result []webrtc.NetworkType
+	for _, name := range strings.Split(types, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		networkType, err := webrtc.NewNetworkType(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network type: %s, expected udp4, udp6, tcp4 or tcp6", name)
+		}
+		result = append(result, networkType)
+	}
+	return result, nil
+}
+
+// Parse a comma separated list of network interfaces, they must exist on this machine
+func ParseInterfaces(names string) ([]string, error) {
+	var result []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, err := net.InterfaceByName(name); err != nil {
+			return nil, fmt.Errorf("Invalid network interface %s: %s", name, err)
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// Parse an mDNS mode: off, query (resolve the other peer's .local names) or gather (also hide our IPs behind one)
+func ParseMulticastDNSMode(mode string) (ice.MulticastDNSMode, error) {
+	switch mode {
+	case "":
+		return 0, nil
+	case "off":
+		return ice.MulticastDNSModeDisabled, nil
+	case "query":
+		return ice.MulticastDNSModeQueryOnly, nil
+	case "gather":
+		return ice.MulticastDNSModeQueryAndGather, nil
+	}
+	return 0, fmt.Errorf("Invalid mDNS mode: %s, expected off, query or gather", mode)
+}
@@ -0,0 +1,79 @@
+package termishare
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// keys read within this time are sent in one message
+	inputFlushInterval = 5 * time.Millisecond
+	// pastes are split in messages of at most this size, well below what browsers accept over SCTP
+	maxInputMessageSize = 16 * 1024
+)
+
+// Coalesces what the user types or pastes into fewer data channel messages
+type inputBatcher struct {
+	lock      sync.Mutex
+	pending   []byte
+	scheduled bool
+	send      func([]byte) error
+}
+
+func newInputBatcher(send func([]byte) error) *inputBatcher {
+	return &inputBatcher{send: send}
+}
+
+func (ib *inputBatcher) Add(keys []byte) {
+	ib.lock.Lock()
+	defer ib.lock.Unlock()
+	ib.pending = append(ib.pending, keys...)
+	for len(ib.pending) >= maxInputMessageSize {
+		ib.sendLocked(ib.pending[:maxInputMessageSize])
+		ib.pending = ib.pending[maxInputMessageSize:]
+	}
+	if len(ib.pending) > 0 && !ib.scheduled {
+		ib.scheduled = true
+		time.AfterFunc(inputFlushInterval, ib.Flush)
+	}
+}
+
+func (ib *inputBatcher) Flush() {
+	ib.lock.Lock()
+	defer ib.lock.Unlock()
+	ib.scheduled = false
+	if len(ib.pending) > 0 {
+		ib.sendLocked(ib.pending)
+		ib.pending = nil
+	}
+}
+
+// sends happen with the lock held so messages keep the order of the keys
+func (ib *inputBatcher) sendLocked(data []byte) {
+	if err := ib.send(append([]byte(nil), data...)); err != nil {
+		log.Printf("Failed to send input: %s", err)
+	}
+}
+
+// Read what the user types and send it to the host with send until r is closed
+// The escape key is handled one byte at a time, so it's detected even when split across reads
+func (rc *RemoteClient) forwardInput(r io.Reader, send func([]byte) error) {
+	batcher := newInputBatcher(send)
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, key := range buf[:n] {
+			keys := rc.handleKey(key)
+			if len(keys) > 0 && !rc.readOnly && !rc.viewOnly {
+				batcher.Add(keys)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to read from stdin: %s", err)
+			batcher.Flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package termishare
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// Feed writes to forwardInput one by one, returns what it sends
+func forward(t *testing.T, writes ...string) chan []byte {
+	t.Helper()
+	r, w := io.Pipe()
+	sent := make(chan []byte, 100)
+	go NewRemoteClient().forwardInput(r, func(data []byte) error {
+		sent <- data
+		return nil
+	})
+	t.Cleanup(func() { w.Close() })
+	for _, data := range writes {
+		// a pipe write returns once it's read, so each one is a separate read
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sent
+}
+
+func TestForwardInputSplitEscapeSequence(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"arrow key", []string{"\x1b", "[A"}, "\x1b[A"},
+		{"arrow key byte by byte", []string{"\x1b", "[", "A"}, "\x1b[A"},
+		{"mouse report", []string{"\x1b[<0;", "10;20M"}, "\x1b[<0;10;20M"},
+		// the client's escape key, typed twice to send it
+		{"escape key", []string{"\x18", "\x18"}, "\x18"},
+	}
+	for _, tt := range tests {
+		sent := forward(t, tt.writes...)
+		written := time.Now()
+		select {
+		case data := <-sent:
+			// allow for a slow scheduler, the flush is a few ms after the first key
+			if elapsed := time.Since(written); elapsed > inputFlushInterval+100*time.Millisecond {
+				t.Errorf("%s: sent after %s", tt.name, elapsed)
+			}
+			if string(data) != tt.want {
+				t.Errorf("%s: sent %q, want %q in one message", tt.name, data, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: nothing sent", tt.name)
+		}
+	}
+}
+
+func TestInputBatcherLargePaste(t *testing.T) {
+	var messages [][]byte
+	ib := newInputBatcher(func(data []byte) error {
+		messages = append(messages, data)
+		return nil
+	})
+	paste := bytes.Repeat([]byte("0123456789"), maxInputMessageSize/4)
+	ib.Add(paste)
+	ib.Flush()
+	if len(messages) != 3 {
+		t.Fatalf("Expected the paste in 3 messages, got %d", len(messages))
+	}
+	for _, m := range messages {
+		if len(m) > maxInputMessageSize {
+			t.Errorf("Message of %d bytes is over %d", len(m), maxInputMessageSize)
+		}
+	}
+	if !bytes.Equal(bytes.Join(messages, nil), paste) {
+		t.Error("The paste wasn't sent in order")
+	}
+}
@@ -0,0 +1,250 @@
+// Manual signaling: without a signaling server, the host gives an offer to the client, e.g. in a chat,
+// and the client gives an answer back. Both include every candidate, so nothing else is exchanged
+// before the peer connection is up, then the passcode is checked over the config channel
+package termishare
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/qnkhuat/termishare/internal/cfg"
+	"github.com/qnkhuat/termishare/pkg/message"
+)
+
+const (
+	// the only client of a session without signaling
+	manualClientID = "manual"
+	// how long to wait for candidates, STUN and TURN servers that don't answer are skipped
+	manualGatherTimeout = 10 * time.Second
+)
+
+// What is in an offer or an answer
+type manualSignal struct {
+	Version     string                    `json:"v"`
+	Description webrtc.SessionDescription `json:"d"`
+	// the host's STUN and TURN servers, like with signaling
+	ICEServers []webrtc.ICEServer `json:"i,omitempty"`
+}
+
+// Compress and encode a signal so it's short enough to copy and paste
+func encodeManualSignal(signal manualSignal) (string, error) {
+	data, err := json.Marshal(signal)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeManualSignal(encoded string) (manualSignal, error) {
+	var signal manualSignal
+	// pasted text may be wrapped or have spaces around
+	encoded = strings.Join(strings.Fields(encoded), "")
+	compressed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return signal, fmt.Errorf("Invalid offer or answer: %s", err)
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return signal, fmt.Errorf("Invalid offer or answer: %s", err)
+	}
+	if err := json.Unmarshal(data, &signal); err != nil {
+		return signal, fmt.Errorf("Invalid offer or answer: %s", err)
+	}
+	if signal.Version != cfg.SUPPORTED_VERSION {
+		return signal, fmt.Errorf("The other side runs termishare version %s, %s is required", signal.Version, cfg.SUPPORTED_VERSION)
+	}
+	return signal, nil
+}
+
+// Set the local description and wait for every candidate, so they're all in it
+func gatherLocalDescription(peerConn *webrtc.PeerConnection, description webrtc.SessionDescription, policy ICEPolicy) (webrtc.SessionDescription, error) {
+	gathered := webrtc.GatheringCompletePromise(peerConn)
+	if err := peerConn.SetLocalDescription(description); err != nil {
+		return description, fmt.Errorf("Failed to set local description: %s", err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(manualGatherTimeout):
+		log.Printf("Timed out gathering candidates, using the ones found so far")
+	}
+	description = *peerConn.LocalDescription()
+	description.SDP = policy.filterSDP(description.SDP)
+	return description, nil
+}
+
+// Create the offer a client needs to join a session with Options.Manual, then give its answer to AcceptManualAnswer
+// Only one client can join this way, a new offer replaces the previous client
+func (ts *Termishare) ManualOffer() (string, error) {
+	if !ts.opts.Manual {
+		return "", fmt.Errorf("The session uses a signaling server")
+	}
+	if ts.getClient(manualClientID) != nil {
+		ts.removeClient(manualClientID)
+	}
+	client, err := ts.newClient(manualClientID)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create client: %s", err)
+	}
+	client.manual = true
+
+	// the offerer opens the data channels
+	for _, label := range []string{cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL, cfg.TERMISHARE_WEBRTC_DATA_CHANNEL} {
+		d, err := client.conn.CreateDataChannel(label, nil)
+		if err != nil {
+			return "", fmt.Errorf("Failed to create data channel: %s", err)
+		}
+		ts.setupDataChannel(manualClientID, client, d)
+	}
+
+	offer, err := client.conn.CreateOffer(nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create offer: %s", err)
+	}
+	offer, err = gatherLocalDescription(client.conn, offer, ts.opts.ICEPolicy)
+	if err != nil {
+		return "", err
+	}
+	return encodeManualSignal(manualSignal{
+		Version:     cfg.TERMISHARE_VERSION,
+		Description: offer,
+		ICEServers:  ts.opts.ICEServers,
+	})
+}
+
+// Connect to the client that answered the last ManualOffer
+func (ts *Termishare) AcceptManualAnswer(answer string) error {
+	client := ts.getClient(manualClientID)
+	if client == nil {
+		return fmt.Errorf("No offer to answer, create one with ManualOffer")
+	}
+	signal, err := decodeManualSignal(answer)
+	if err != nil {
+		return err
+	}
+	if err := client.conn.SetRemoteDescription(signal.Description); err != nil {
+		return fmt.Errorf("Failed to set remote description: %s", err)
+	}
+	ts.emit(Event{Type: EventClientJoined, ClientID: manualClientID})
+	return nil
+}
+
+// Join a session with an offer from a host without a signaling server
+// answer is called with what to give back to the host, then it blocks until the host accepts us
+func (rc *RemoteClient) joinManual(offer string, answer func(string)) error {
+	rc.manual = true
+	signal, err := decodeManualSignal(offer)
+	if err != nil {
+		rc.Stop(err.Error())
+		return rc.stopError()
+	}
+
+	peerConn, err := rc.createPeerConnection(signal.ICEServers)
+	if err != nil {
+		log.Printf("Failed to create peer connetion : %s", err)
+		rc.Stop("Failed to connect to termishare session")
+		return rc.stopError()
+	}
+	rc.lock.Lock()
+	rc.peerConn = peerConn
+	rc.lock.Unlock()
+
+	// the host opens the data channels
+	peerConn.OnDataChannel(func(d *webrtc.DataChannel) {
+		switch d.Label() {
+		case cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL:
+			d.OnMessage(rc.handleConfigMessage)
+			if rc.viewOnly {
+				d.OnOpen(func() {
+					rc.sendConfig(message.Wrapper{Type: message.TCViewer})
+				})
+			}
+			rc.lock.Lock()
+			rc.configChannel = d
+			rc.lock.Unlock()
+		case cfg.TERMISHARE_WEBRTC_DATA_CHANNEL:
+			d.OnMessage(rc.handleData)
+			rc.lock.Lock()
+			rc.dataChannel = d
+			rc.lock.Unlock()
+		}
+	})
+
+	if err := peerConn.SetRemoteDescription(signal.Description); err != nil {
+		rc.Stop(fmt.Sprintf("Failed to set remote description: %s", err))
+		return rc.stopError()
+	}
+	description, err := peerConn.CreateAnswer(nil)
+	if err != nil {
+		rc.Stop(fmt.Sprintf("Failed to create answer: %s", err))
+		return rc.stopError()
+	}
+	description, err = gatherLocalDescription(peerConn, description, rc.icePolicy)
+	if err != nil {
+		rc.Stop(err.Error())
+		return rc.stopError()
+	}
+	encoded, err := encodeManualSignal(manualSignal{Version: cfg.TERMISHARE_VERSION, Description: description})
+	if err != nil {
+		rc.Stop(fmt.Sprintf("Failed to encode answer: %s", err))
+		return rc.stopError()
+	}
+	answer(encoded)
+
+	select {
+	case <-rc.joined:
+		return nil
+	case <-rc.done:
+		return rc.stopError()
+	}
+}
+
+// Join a session in the terminal with an offer from a host without a signaling server
+func (rc *RemoteClient) ConnectManual(offer string) {
+	log.Printf("Start manual")
+	rc.connect(func() error {
+		return rc.joinManual(offer, func(answer string) {
+			fmt.Printf("Give this answer to the host:\n\n%s\n\nWaiting for the host...\n", answer)
+		})
+	})
+}
+
+// Print an offer and read the client's answer in the terminal
+func (ts *Termishare) exchangeManually() error {
+	fmt.Println("Gathering candidates...")
+	offer, err := ts.ManualOffer()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Give this offer to the client, to join with 'termishare -manual join':\n\n%s\n\n", offer)
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("Paste the client's answer: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("Failed to read answer: %s", err)
+		}
+		if strings.TrimSpace(answer) == "" {
+			continue
+		}
+		if err := ts.AcceptManualAnswer(answer); err != nil {
+			fmt.Printf("%s\n", err)
+			continue
+		}
+		return nil
+	}
+}
@@ -0,0 +1,218 @@
+package termishare
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// As a proxy, never use one, not even from the environment
+const ProxyDirect = "direct"
+
+const proxyDialTimeout = 10 * time.Second
+
+// Parse a proxy url: http://, https:// or socks5://, with user:password@ to authenticate
+func ParseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy: %s, expected a url like http://proxy:3128 or socks5://proxy:1080", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, fmt.Errorf("Invalid proxy: %s, only http, https and socks5 proxies are supported", proxy)
+}
+
+// The proxy to reach target through, nil to connect directly
+// An empty proxy is taken from HTTPS_PROXY or HTTP_PROXY depending on the scheme of target, then ALL_PROXY,
+// unless target is in NO_PROXY
+func proxyFor(proxy string, target *url.URL) (*url.URL, error) {
+	switch proxy {
+	case ProxyDirect:
+		return nil, nil
+	case "":
+		conf := httpproxy.FromEnvironment()
+		all := os.Getenv("ALL_PROXY")
+		if all == "" {
+			all = os.Getenv("all_proxy")
+		}
+		if conf.HTTPSProxy == "" {
+			conf.HTTPSProxy = all
+		}
+		if conf.HTTPProxy == "" {
+			conf.HTTPProxy = all
+		}
+		// httpproxy only knows http and https
+		switch target.Scheme {
+		case "ws":
+			target = &url.URL{Scheme: "http", Host: target.Host}
+		case "wss":
+			target = &url.URL{Scheme: "https", Host: target.Host}
+		}
+		return conf.ProxyFunc()(target)
+	}
+	return ParseProxy(proxy)
+}
+
+// Whether connections may go through a proxy, set or from the environment
+func proxyConfigured(proxy string) bool {
+	if proxy == ProxyDirect {
+		return false
+	}
+	if proxy != "" {
+		return true
+	}
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy"} {
+		if os.Getenv(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Open a TCP connection to addr through proxyURL, or directly if it's nil, giving up when ctx is done
+func dialThroughProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: proxyDialTimeout}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxyURL.Scheme]
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	if proxyURL.Scheme == "socks5" {
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", proxyAddr, auth, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to proxy %s: %s", proxyURL.Host, err)
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	// http and https proxies: ask for a tunnel with CONNECT
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %s", proxyURL.Host, err)
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+	deadline := time.Now().Add(proxyDialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %s", proxyURL.Host, err)
+	}
+	// the server doesn't speak before we do, so nothing after the response is lost with the reader
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %s", proxyURL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused to connect to %s: %s", proxyURL.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// A websocket dialer to connect to wsURL through the proxy
+func websocketDialer(proxy string, wsURL string) (*websocket.Dialer, error) {
+	target, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, err
+	}
+	proxyURL, err := proxyFor(proxy, target)
+	if err != nil {
+		return nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = nil
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialThroughProxy(ctx, proxyURL, addr)
+	}
+	return &dialer, nil
+}
+
+// Dials TURN servers over TCP and TLS through the proxy, for pion's SettingEngine.SetICEProxyDialer
+type iceProxyDialer struct {
+	proxy string
+	// addresses of turns: servers, to their host name: pion doesn't do TLS itself when it uses a proxy dialer
+	tlsServers map[string]string
+}
+
+func newICEProxyDialer(proxy string, servers []webrtc.ICEServer) *iceProxyDialer {
+	d := &iceProxyDialer{proxy: proxy, tlsServers: map[string]string{}}
+	for _, server := range servers {
+		for _, u := range server.URLs {
+			if !strings.HasPrefix(u, "turns:") {
+				continue
+			}
+			// turns:host:port?transport=tcp
+			hostPort := strings.SplitN(strings.TrimPrefix(u, "turns:"), "?", 2)[0]
+			host, _, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				host, hostPort = hostPort, net.JoinHostPort(hostPort, "5349")
+			}
+			d.tlsServers[hostPort] = host
+		}
+	}
+	return d
+}
+
+func (d *iceProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	proxyURL, err := proxyFor(d.proxy, &url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialThroughProxy(context.Background(), proxyURL, addr)
+	if err != nil {
+		return nil, err
+	}
+	if serverName, ok := d.tlsServers[addr]; ok {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed TLS handshake with %s: %s", addr, err)
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
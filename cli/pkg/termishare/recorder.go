@@ -0,0 +1,81 @@
+package termishare
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/qnkhuat/termishare/pkg/pty"
+	"github.com/qnkhuat/termishare/pkg/recording"
+)
+
+// Records what a RemoteClient receives from the host
+// The recording header needs the host's terminal size, so output received before the first winsize is kept in memory
+type clientRecorder struct {
+	lock    sync.Mutex
+	out     io.Writer
+	start   time.Time
+	writer  *recording.Writer
+	pending []pendingOutput
+}
+
+type pendingOutput struct {
+	at   time.Time
+	data []byte
+}
+
+func newClientRecorder(out io.Writer) *clientRecorder {
+	// the header timestamp only has a precision of seconds, event times are relative to it
+	return &clientRecorder{out: out, start: time.Unix(time.Now().Unix(), 0)}
+}
+
+func (cr *clientRecorder) Write(data []byte) (int, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.writer == nil {
+		cr.pending = append(cr.pending, pendingOutput{at: time.Now(), data: append([]byte(nil), data...)})
+		return len(data), nil
+	}
+	return len(data), cr.writer.WriteOutput(time.Since(cr.start).Seconds(), data)
+}
+
+func (cr *clientRecorder) Resize(cols, rows int) error {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.writer == nil {
+		return cr.begin(cols, rows)
+	}
+	return cr.writer.WriteResize(time.Since(cr.start).Seconds(), cols, rows)
+}
+
+func (cr *clientRecorder) Close() error {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.writer == nil {
+		// never got the host's winsize, save what we have with the size of this terminal
+		cols, rows := 0, 0
+		if ws, err := pty.GetWinsize(0); err == nil {
+			cols, rows = int(ws.Cols), int(ws.Rows)
+		}
+		if err := cr.begin(cols, rows); err != nil {
+			return err
+		}
+	}
+	return cr.writer.Close()
+}
+
+// write the header and everything received so far, must be called with the lock held
+func (cr *clientRecorder) begin(cols, rows int) error {
+	writer, err := recording.NewWriter(cr.out, recording.Header{Width: cols, Height: rows, Timestamp: cr.start.Unix()})
+	if err != nil {
+		return err
+	}
+	cr.writer = writer
+	for _, p := range cr.pending {
+		if err := writer.WriteOutput(p.at.Sub(cr.start).Seconds(), p.data); err != nil {
+			return err
+		}
+	}
+	cr.pending = nil
+	return nil
+}
@@ -0,0 +1,246 @@
+// Relay: when the peer connection doesn't get connected, e.g. UDP and TURN are both blocked,
+// the client asks the host to tunnel the data and config channels through the signaling server instead.
+//
+// So the server can't read what's relayed, the client and the host each send an ephemeral X25519 public key
+// in a Relay message, and derive the keys with HKDF-SHA256 from the shared secret.
+// The key exchange isn't authenticated: it only protects against a server that reads the messages it forwards,
+// a malicious one can put itself in the middle of it, as it can read the passcode the client sent through it anyway.
+// Each direction has its own ChaCha20-Poly1305 key and the nonce of a message is its index.
+// Messages must arrive in order: the stream of a terminal can't skip anything, so a missing message ends the relay,
+// and sending waits for room in the websocket's buffer rather than dropping what doesn't fit.
+// The host queues what it relays to each client, so a slow client is dropped instead of holding up the terminal
+package termishare
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/qnkhuat/termishare/pkg/message"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	errRelayGap       = errors.New("Relayed messages were lost")
+	errRelayQueueFull = errors.New("Too many messages waiting to be relayed")
+)
+
+const (
+	// how long a client waits for the peer connection to be connected before asking to relay
+	DefaultRelayTimeout = 15 * time.Second
+	// relayed data is split so messages stay under the signaling server's size limit
+	relayChunkSize = 16 * 1024
+	// how long sending waits for the signaling connection to catch up before the relay is given up on
+	relaySendTimeout = 10 * time.Second
+	// writes queued for a relayed client, it's dropped if it falls further behind
+	relayQueueSize = 1024
+	// a relayed client sends a ping this often, and the host drops it after relayIdleTimeout without any message
+	relayKeepAliveInterval = 20 * time.Second
+	relayIdleTimeout       = 3 * relayKeepAliveInterval
+)
+
+// One side of a relayed connection
+type relay struct {
+	seal cipher.AEAD
+	open cipher.AEAD
+	// sends a RelayData message to the other side through the signaling server, waiting for room to send it
+	write func(message.Wrapper) error
+
+	// held while sending, so messages are written in the order of their index
+	sendLock  sync.Mutex
+	sendIndex uint64
+
+	lock         sync.Mutex
+	receiveIndex uint64
+	lastReceived time.Time
+
+	// see startQueue
+	pending  chan relayedWrite
+	overflow chan bool
+	stopped  chan bool
+	stopOnce sync.Once
+}
+
+// A write waiting in the queue of a relay
+type relayedWrite struct {
+	channel string
+	data    []byte
+}
+
+// An ephemeral key pair for the key exchange, the public key encoded for a Relay message
+func newRelayKey() ([]byte, string, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, "", err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, "", err
+	}
+	return private, base64.StdEncoding.EncodeToString(public), nil
+}
+
+// Derive the keys of a relay from our private key and the other side's public key
+// host tells which side we are, both sides must use the same session ID
+func newRelay(private []byte, peerPublic string, host bool, sessionID string, write func(message.Wrapper) error) (*relay, error) {
+	peer, err := base64.StdEncoding.DecodeString(peerPublic)
+	if err != nil || len(peer) != curve25519.PointSize {
+		return nil, fmt.Errorf("Invalid relay public key")
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(private, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	hostPublic, clientPublic := public, peer
+	if !host {
+		hostPublic, clientPublic = peer, public
+	}
+	salt := append(append([]byte{}, hostPublic...), clientPublic...)
+	kdf := hkdf.New(sha256.New, shared, salt, []byte("termishare relay "+sessionID))
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, err
+	}
+	hostToClient, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	clientToHost, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &relay{seal: clientToHost, open: hostToClient, write: write, lastReceived: time.Now()}
+	if host {
+		r.seal, r.open = hostToClient, clientToHost
+	}
+	return r, nil
+}
+
+// Encrypt data for a channel and send it, split in chunks if it's large
+// After an error the other side misses a message, so the relay can't be used anymore
+func (r *relay) send(channel string, data []byte) error {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > relayChunkSize {
+			chunk = chunk[:relayChunkSize]
+		}
+		data = data[len(chunk):]
+
+		index := r.sendIndex
+		r.sendIndex++
+		msg := message.Wrapper{
+			Type: message.TCRelayData,
+			Data: message.RelayData{
+				Channel: channel,
+				Index:   index,
+				Sealed:  r.seal.Seal(nil, relayNonce(index), chunk, []byte(channel)),
+			},
+		}
+		if err := r.write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send what's queued in the background, in order, for callers that can't wait on the signaling connection
+// failed is called once when a send fails or the queue is full, nothing is sent after
+func (r *relay) startQueue(failed func(error)) {
+	r.pending = make(chan relayedWrite, relayQueueSize)
+	r.overflow = make(chan bool, 1)
+	r.stopped = make(chan bool)
+	go func() {
+		for {
+			select {
+			case w := <-r.pending:
+				if err := r.send(w.channel, w.data); err != nil {
+					failed(err)
+					return
+				}
+			case <-r.overflow:
+				failed(errRelayQueueFull)
+				return
+			case <-r.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// Queue data to be sent by startQueue's goroutine, never blocks
+func (r *relay) queue(channel string, data []byte) {
+	// callers like io.MultiWriter reuse their buffer
+	w := relayedWrite{channel: channel, data: append([]byte{}, data...)}
+	select {
+	case r.pending <- w:
+	default:
+		select {
+		case r.overflow <- true:
+		default:
+		}
+	}
+}
+
+// Stop the goroutine of startQueue, what's still queued is dropped
+func (r *relay) stopQueue() {
+	r.stopOnce.Do(func() {
+		if r.stopped != nil {
+			close(r.stopped)
+		}
+	})
+}
+
+// Decrypt a RelayData message, returns the channel it's for and the data
+// errRelayGap means a message was lost, the relay can't be used anymore
+func (r *relay) receive(msg message.Wrapper) (string, []byte, error) {
+	d := message.RelayData{}
+	if err := message.ToStruct(msg.Data, &d); err != nil {
+		return "", nil, fmt.Errorf("Invalid relayed message: %s", err)
+	}
+	data, err := r.open.Open(nil, relayNonce(d.Index), d.Sealed, []byte(d.Channel))
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to decrypt relayed message")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if d.Index < r.receiveIndex {
+		return "", nil, fmt.Errorf("Relayed message %d was already received", d.Index)
+	}
+	if d.Index > r.receiveIndex {
+		return "", nil, fmt.Errorf("%w: expected message %d, got %d", errRelayGap, r.receiveIndex, d.Index)
+	}
+	r.receiveIndex = d.Index + 1
+	r.lastReceived = time.Now()
+	return d.Channel, data, nil
+}
+
+// How long since the other side sent something
+func (r *relay) idle() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return time.Since(r.lastReceived)
+}
+
+func relayNonce(index uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], index)
+	return nonce
+}
@@ -3,12 +3,15 @@
 package termishare
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	ptyDevice "github.com/creack/pty"
@@ -18,6 +21,20 @@ import (
 	"github.com/qnkhuat/termishare/internal/cfg"
 	"github.com/qnkhuat/termishare/pkg/message"
 	"github.com/qnkhuat/termishare/pkg/pty"
+	"github.com/qnkhuat/termishare/pkg/vt"
+	term "golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// how long a disconnected peer connection gets to recover by itself before we try to reconnect
+	reconnectGracePeriod = 3 * time.Second
+	// how long one reconnect attempt waits for the peer connection to be connected
+	reconnectTimeout     = 10 * time.Second
+	reconnectMaxAttempts = 10
+	reconnectMaxBackoff  = 30 * time.Second
+
+	// how many times the user can enter a wrong passcode before we give up
+	maxPasscodeAttempts = 3
 )
 
 type RemoteClient struct {
@@ -33,47 +50,151 @@ type RemoteClient struct {
 	wsConn *WebSocket
 	pty    *pty.Pty
 
-	// store the previously pressed key to detect exit sequence
-	previousKey byte
-	done        chan bool
-	winSizes    struct {
+	server    string
+	sessionID string
+	// STUN and TURN servers, used along the ones the host sends
+	iceServers []webrtc.ICEServer
+	// ignore the TURN servers the host sends
+	noTURN    bool
+	icePolicy ICEPolicy
+	proxy     string
+	signaling SignalingOptions
+	// joined with an offer from the host instead of a signaling server
+	manual bool
+	// how long to wait for the peer connection before relaying through the signaling server, 0 to never relay
+	relayTimeout time.Duration
+	// our key while waiting for the host to accept relaying, then the relay, see relay.go
+	relayKey []byte
+	relay    *relay
+	// the passcode accepted by the host, sent again when reconnecting
+	passcode string
+	// the passcode was given with SetPasscode, so don't ask for it
+	passcodeGiven    bool
+	passcodeAttempts int
+
+	// the key that opens the command menu, and whether it was just pressed
+	escapeKey byte
+	escaping  bool
+	// don't send what the user types to the host
+	readOnly bool
+	// joined with SetViewOnly, readOnly can't be turned off
+	viewOnly bool
+
+	done     chan bool
+	stopOnce sync.Once
+	winSizes struct {
 		remoteRows uint16
 		remoteCols uint16
 		thisRows   uint16
 		thisCols   uint16
 	}
-	muteDisplay bool
-	connected   bool
+	// closed once the host accepts us for the first time
+	joined       chan bool
+	connected    bool
+	reconnecting bool
+	stopped      bool
+	stopReason   string
+	// guards the connections and the states above
+	lock sync.Mutex
+
+	// model of the host's screen, used to show part of it when our terminal is smaller
+	screen *vt.Screen
+	view   viewport
+
+	// if set, everything received from the host is recorded
+	recorder *clientRecorder
+
+	// set when running a command with Exec instead of an interactive session
+	exec *execSession
+	// set when used as a library through a Session
+	session            *Session
+	askSessionPasscode func(incorrect bool) (string, error)
+
+	rtt rttProbe
 }
 
 func NewRemoteClient() *RemoteClient {
 	return &RemoteClient{
-		pty:         pty.New(),
-		clientID:    uuid.NewString(),
-		muteDisplay: false,
-		connected:   false,
-		done:        make(chan bool),
+		pty:          pty.New(),
+		clientID:     uuid.NewString(),
+		connected:    false,
+		escapeKey:    DefaultEscapeKey,
+		iceServers:   DefaultICEServers(),
+		relayTimeout: DefaultRelayTimeout,
+		done:         make(chan bool),
+		joined:       make(chan bool),
 	}
 }
 
+// Join as a viewer: never send what the user types, and tell the host so
+// Must be called before Connect
+func (rc *RemoteClient) SetViewOnly(viewOnly bool) {
+	rc.viewOnly = viewOnly
+	rc.readOnly = viewOnly
+}
+
+// Use these STUN and TURN servers instead of the default ones, must be called before Connect
+func (rc *RemoteClient) SetICEServers(servers []webrtc.ICEServer) {
+	rc.iceServers = servers
+}
+
+// Never use a TURN server, not even the ones the host sends, must be called before Connect
+func (rc *RemoteClient) SetNoTURN(noTURN bool) {
+	rc.noTURN = noTURN
+}
+
+// Which candidates are gathered and sent to the host, must be called before Connect
+func (rc *RemoteClient) SetICEPolicy(policy ICEPolicy) {
+	rc.icePolicy = policy
+}
+
+// Proxy to the signaling server and TURN servers, see Options.Proxy, must be called before Connect
+func (rc *RemoteClient) SetProxy(proxy string) {
+	rc.proxy = proxy
+}
+
+// How long to wait for the peer connection to be connected before relaying through the signaling server,
+// DefaultRelayTimeout by default, 0 to never relay. Must be called before Connect
+func (rc *RemoteClient) SetRelayTimeout(timeout time.Duration) {
+	rc.relayTimeout = timeout
+}
+
+// TLS and authentication for a private signaling server, must be called before Connect
+func (rc *RemoteClient) SetSignalingOptions(signaling SignalingOptions) {
+	rc.signaling = signaling
+}
+
+// Use this passcode instead of asking for it when the session requires one
+func (rc *RemoteClient) SetPasscode(passcode string) {
+	rc.passcode = passcode
+	rc.passcodeGiven = true
+}
+
+// Record everything received from the host to w, must be called before Connect
+func (rc *RemoteClient) Record(w io.Writer) {
+	rc.recorder = newClientRecorder(w)
+}
+
 func (rc *RemoteClient) Connect(server string, sessionID string) {
 	log.Printf("Start")
-	wsURL := GetWSURL(server, sessionID)
-	fmt.Printf("Connecting to: %s\n", wsURL)
+	fmt.Printf("Connecting to: %s\n", sessionURL(server, sessionID))
+	rc.connect(func() error {
+		return rc.join(context.Background(), server, sessionID)
+	})
+}
 
-	wsConn, err := NewWebSocketConnection(wsURL)
-	if err != nil {
-		log.Printf("Failed to connect to singaling server: %s", err)
-		rc.Stop("Failed to connect to signaling server")
-	}
-	go wsConn.Start()
+// Join the session in the terminal once join returns
+func (rc *RemoteClient) connect(join func() error) {
 
 	winsize, err := pty.GetWinsize(0)
 	if err != nil {
 		rc.Stop("Failed to start")
+		return
 	}
 	rc.winSizes.thisCols = winsize.Cols
 	rc.winSizes.thisRows = winsize.Rows
+	// until we know the host's size
+	rc.screen = vt.New(int(winsize.Cols), int(winsize.Rows))
 
 	rc.pty.SetWinChangeCB(func(ws *ptyDevice.Winsize) {
 		rc.winSizes.thisCols = ws.Cols
@@ -81,76 +202,164 @@ func (rc *RemoteClient) Connect(server string, sessionID string) {
 		rc.maybeNeedResize()
 	})
 
-	// Initiate peer connection
-	iceServers := cfg.TERMISHARE_ICE_SERVER_STUNS
-	iceServers = append(iceServers, cfg.TERMISHARE_ICE_SERVER_TURNS...)
+	if err := join(); err != nil {
+		return
+	}
 
-	config := webrtc.Configuration{
-		ICEServers:   iceServers,
-		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
+	// should be connected by now
+	fmt.Printf("Press '%s .' to exit, '%s ?' for more commands\n", KeyName(rc.escapeKey), KeyName(rc.escapeKey))
+	rc.pty.MakeRaw()
+	defer rc.pty.Restore()
+
+	// Read from stdin and send to the host
+	go rc.forwardInput(os.Stdin, rc.sendData)
+
+	// Wait
+	<-rc.done
+	return
+}
+
+// Connect to the session and block until the host accepts us
+// On failure the client is stopped and the reason returned, but not when ctx is done first: it returns ctx.Err()
+func (rc *RemoteClient) join(ctx context.Context, server string, sessionID string) error {
+	rc.server = server
+	rc.sessionID = sessionID
+
+	if err := rc.connectSignaling(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("Failed to connect to singaling server: %s", err)
+		// e.g. a certificate or authentication error the user can fix
+		rc.Stop(fmt.Sprintf("Failed to connect to signaling server: %s", err))
+		return rc.stopError()
+	}
+
+	// the peer connection is created once the host accepts us, with the ICE servers it sends
+	rc.sendConnect()
+	select {
+	case <-rc.joined:
+		return nil
+	case <-rc.done:
+		return rc.stopError()
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	peerConn, err := webrtc.NewPeerConnection(config)
+// Open a websocket connection to the signaling server and handle its messages
+func (rc *RemoteClient) connectSignaling(ctx context.Context) error {
+	serverURL, err := ParseServerURL(rc.server)
+	if err != nil {
+		return err
+	}
+	wsConn, err := dialWebSocket(ctx, serverURL.WebSocketURL(rc.sessionID), rc.proxy, rc.signaling)
 	if err != nil {
-		log.Printf("Failed to create peer connetion : %s", err)
+		return err
 	}
+	go wsConn.Start()
 
-	rc.peerConn = peerConn
+	rc.lock.Lock()
+	rc.wsConn = wsConn
+	rc.lock.Unlock()
 
-	peerConn.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		log.Printf("Peer connection state has changed: %s", s.String())
-		switch s {
-		case webrtc.PeerConnectionStateClosed:
-		case webrtc.PeerConnectionStateDisconnected:
-		case webrtc.PeerConnectionStateFailed:
-			rc.Stop("Disconnected!")
+	go func() {
+		for msg := range wsConn.In {
+			// only read message sent from the host to us
+			if msg.From != cfg.TERMISHARE_WEBSOCKET_HOST_ID || (msg.To != "" && msg.To != rc.clientID) {
+				continue
+			}
+
+			err := rc.handleWebSocketMessage(msg)
+			if err != nil {
+				log.Printf("Failed to handle message: %v, with error: %s", msg, err)
+			}
 		}
-	})
+		log.Printf("Websocket connection closed")
+
+		// the signaling connection is only needed again when reconnecting, unless everything goes through it
+		select {
+		case <-rc.joined:
+			if rc.getRelay() != nil {
+				rc.Stop("Connection to signaling server is closed")
+			}
+		default:
+			rc.Stop("Connection to signaling server is closed")
+		}
+	}()
+	return nil
+}
+
+// Create a new peer connection to the host, replacing the current one
+// The host's ICE servers are used along ours, so both sides can use the same relay
+func (rc *RemoteClient) newPeerConnection(hostICEServers []webrtc.ICEServer) error {
+	peerConn, err := rc.createPeerConnection(hostICEServers)
+	if err != nil {
+		return err
+	}
 
 	configChannel, err := peerConn.CreateDataChannel(cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL, nil)
+	if err != nil {
+		peerConn.Close()
+		return err
+	}
 	dataChannel, err := peerConn.CreateDataChannel(cfg.TERMISHARE_WEBRTC_DATA_CHANNEL, nil)
+	if err != nil {
+		peerConn.Close()
+		return err
+	}
+	configChannel.OnMessage(rc.handleConfigMessage)
+	dataChannel.OnMessage(rc.handleData)
+
+	rc.lock.Lock()
+	old := rc.peerConn
+	rc.peerConn = peerConn
 	rc.configChannel = configChannel
 	rc.dataChannel = dataChannel
+	rc.lock.Unlock()
 
-	configChannel.OnMessage(func(webrtcMsg webrtc.DataChannelMessage) {
-		msg := &message.Wrapper{}
-		err := json.Unmarshal(webrtcMsg.Data, msg)
-		if err != nil {
-			log.Printf("Failed to read config message: %s", err)
-			return
-		}
-
-		log.Printf("Config channel got msg: %v", msg)
-		switch msg.Type {
-		case message.TTermWinsize:
-			ws := &message.Winsize{}
-			err = message.ToStruct(msg.Data, ws)
-			if err != nil {
-				log.Printf("Failed to decode winsize message: %s", err)
-				return
-			}
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
 
-			rc.winSizes.remoteCols = ws.Cols
-			rc.winSizes.remoteRows = ws.Rows
-			rc.maybeNeedResize()
+func (rc *RemoteClient) createPeerConnection(hostICEServers []webrtc.ICEServer) (*webrtc.PeerConnection, error) {
+	if rc.noTURN {
+		hostICEServers = WithoutTURN(hostICEServers)
+	}
+	config := webrtc.Configuration{
+		ICEServers:   mergeICEServers(hostICEServers, rc.iceServers),
+		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
+	}
 
-		default:
-			log.Printf("Unhandled msg config type: %s", msg.Type)
-		}
-	})
+	peerConn, err := rc.icePolicy.newPeerConnection(config, rc.proxy)
+	if err != nil {
+		return nil, err
+	}
 
-	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if !rc.muteDisplay {
-			os.Stdout.Write(msg.Data)
+	peerConn.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		log.Printf("Peer connection state has changed: %s", s.String())
+		switch s {
+		case webrtc.PeerConnectionStateDisconnected:
+			// often recovers by itself, e.g. after a short network hiccup
+			time.AfterFunc(reconnectGracePeriod, func() {
+				if peerConn.ConnectionState() == webrtc.PeerConnectionStateDisconnected {
+					rc.reconnect(peerConn)
+				}
+			})
+		case webrtc.PeerConnectionStateFailed:
+			rc.reconnect(peerConn)
 		}
 	})
 
 	peerConn.OnICECandidate(func(ice *webrtc.ICECandidate) {
-		if ice == nil {
+		// without signaling, candidates are in the answer
+		if ice == nil || rc.manual || !rc.icePolicy.shareCandidate(ice) {
 			return
 		}
 
-		candidate, err := json.Marshal(ice.ToJSON())
+		candidate, err := json.Marshal(rc.icePolicy.candidateInit(ice))
 		if err != nil {
 			log.Printf("Failed to decode ice candidate: %s", err)
 			return
@@ -163,134 +372,392 @@ func (rc *RemoteClient) Connect(server string, sessionID string) {
 
 		rc.writeWebsocket(msg)
 	})
+	return peerConn, nil
+}
 
-	// block until handleWebSocketMessage set rc.connected to true
-	rc.wsConn = wsConn
-	rc.writeWebsocket(message.Wrapper{
-		Type: message.TCConnect,
-		Data: cfg.TERMISHARE_VERSION})
-	for {
-		if rc.connected {
-			break
-		}
+func (rc *RemoteClient) handleConfigMessage(webrtcMsg webrtc.DataChannelMessage) {
+	msg := &message.Wrapper{}
+	err := json.Unmarshal(webrtcMsg.Data, msg)
+	if err != nil {
+		log.Printf("Failed to read config message: %s", err)
+		return
+	}
 
-		msg, ok := <-rc.wsConn.In
-		if !ok {
-			log.Printf("Failed to read websocket message")
-			break
+	log.Printf("Config channel got msg: %v", msg)
+	switch msg.Type {
+	case message.TTermWinsize:
+		ws := &message.Winsize{}
+		err = message.ToStruct(msg.Data, ws)
+		if err != nil {
+			log.Printf("Failed to decode winsize message: %s", err)
+			return
 		}
 
-		// only read message sent from the host
-		if msg.From != cfg.TERMISHARE_WEBSOCKET_HOST_ID {
-			log.Printf("Skip message :%v", msg)
+		rc.winSizes.remoteCols = ws.Cols
+		rc.winSizes.remoteRows = ws.Rows
+		rc.screen.Resize(int(ws.Cols), int(ws.Rows))
+		rc.maybeNeedResize()
+		if rc.recorder != nil {
+			rc.recorder.Resize(int(ws.Cols), int(ws.Rows))
 		}
+		rc.notify(Event{Type: EventWinsize, Cols: int(ws.Cols), Rows: int(ws.Rows)})
 
-		err := rc.handleWebSocketMessage(msg)
-		if err != nil {
+	case message.TRTTPing:
+		rc.sendConfig(message.Wrapper{Type: message.TRTTPong, Data: msg.Data})
+
+	case message.TRTTPong:
+		rc.rtt.pong(*msg)
+
+	// without signaling, the host asks for the passcode over the config channel
+	case message.TCRequirePasscode, message.TCNoPasscode, message.TCAuthenticated, message.TCUnauthenticated:
+		if !rc.manual {
+			log.Printf("Ignored %s from the config channel", msg.Type)
+			return
+		}
+		if err := rc.handleWebSocketMessage(*msg); err != nil {
 			log.Printf("Failed to handle message: %v, with error: %s", msg, err)
-			break
 		}
+
+	default:
+		log.Printf("Unhandled msg config type: %s", msg.Type)
 	}
+}
 
-	// should be connected by now
-	fmt.Println("Press 'Ctrl-x + Ctrl-x' to exit")
-	rc.pty.MakeRaw()
-	defer rc.pty.Restore()
+func (rc *RemoteClient) handleData(msg webrtc.DataChannelMessage) {
+	if rc.recorder != nil {
+		rc.recorder.Write(msg.Data)
+	}
+	if rc.exec != nil {
+		rc.exec.Write(msg.Data)
+		return
+	}
+	rc.screen.Write(msg.Data)
+	if rc.session != nil {
+		rc.session.receive(msg.Data)
+		return
+	}
+	if rc.viewportEnabled() {
+		rc.scheduleViewportRender()
+	} else {
+		os.Stdout.Write(msg.Data)
+	}
+}
 
-	// Read from stdin and send to the host
-	stdinReader := bufio.NewReaderSize(os.Stdin, 1)
-	go func() {
-		for {
-			d, err := stdinReader.ReadByte()
-			if err != nil {
-				log.Printf("Failed to read from stdin: %s", err)
-				continue
-			}
-			// if detects Ctrl-x + Ctrl-x => stop
-			if rc.previousKey == byte('\x18') && d == byte('\x18') {
-				log.Printf("Escape key detected. Exiting")
-				rc.Stop("Disconnected!")
-				break
-			}
-			rc.previousKey = d
-			if rc.dataChannel != nil {
-				rc.dataChannel.Send([]byte{d})
-			}
-		}
+// Reconnect after the peer connection to the host is lost.
+// The first attempt restarts ICE on the current connection if the signaling server is still reachable,
+// the next ones go through signaling again with the same client ID and passcode
+func (rc *RemoteClient) reconnect(lost *webrtc.PeerConnection) {
+	rc.lock.Lock()
+	// the peer connection is given up on when relaying
+	if rc.stopped || rc.reconnecting || rc.peerConn != lost || rc.relayKey != nil || rc.relay != nil {
+		rc.lock.Unlock()
+		return
+	}
+	rc.reconnecting = true
+	rc.lock.Unlock()
+
+	// there's no signaling server to reconnect through
+	if rc.manual {
+		rc.Stop("Disconnected!")
+		return
+	}
+
+	defer func() {
+		rc.lock.Lock()
+		rc.reconnecting = false
+		rc.lock.Unlock()
 	}()
 
-	// handle websocket messages
-	go func() {
-		for {
-			msg, ok := <-rc.wsConn.In
-			if !ok {
-				log.Printf("Failed to read websocket message")
-				break
+	backoff := time.Second
+	for attempt := 1; attempt <= reconnectMaxAttempts; attempt++ {
+		if rc.isStopped() || rc.isRelaying() {
+			return
+		}
+		log.Printf("Reconnecting, attempt %d", attempt)
+		rc.showStatus(fmt.Sprintf("Connection lost, reconnecting (%d/%d)...", attempt, reconnectMaxAttempts))
+		rc.notify(Event{Type: EventReconnecting})
+
+		err := rc.tryReconnect(attempt == 1)
+		if err == nil {
+			log.Printf("Reconnected")
+			// the host sends everything again on new data channels, but not after an ICE restart
+			if err := rc.requestRemoteRefresh(); err != nil {
+				log.Printf("Failed to request refresh: %s", err)
 			}
+			rc.showStatus("Reconnected")
+			rc.notify(Event{Type: EventReconnected})
+			return
+		}
+		log.Printf("Failed to reconnect: %s", err)
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+	rc.Stop("Disconnected!")
+}
+
+func (rc *RemoteClient) tryReconnect(iceRestart bool) error {
+	wsAlive := rc.getWebSocket() != nil && rc.getWebSocket().Active()
 
-			// only read message sent from the host
-			if msg.From != cfg.TERMISHARE_WEBSOCKET_HOST_ID {
-				log.Printf("Skip message :%v", msg)
+	// an ICE restart keeps the data channels, but only works while the connection isn't failed yet
+	if iceRestart && wsAlive && rc.getPeerConn().ConnectionState() == webrtc.PeerConnectionStateDisconnected {
+		log.Printf("Restarting ICE")
+		err := rc.sendOffer(&webrtc.OfferOptions{ICERestart: true})
+		if err == nil {
+			if err = rc.waitConnected(reconnectTimeout); err == nil {
+				return nil
 			}
+		}
+		log.Printf("Failed to restart ICE: %s", err)
+	}
 
-			err := rc.handleWebSocketMessage(msg)
-			if err != nil {
-				log.Printf("Failed to handle message: %v, with error: %s", msg, err)
-				break
+	if !wsAlive {
+		if err := rc.connectSignaling(context.Background()); err != nil {
+			return fmt.Errorf("Failed to connect to signaling server: %s", err)
+		}
+	}
+
+	if err := rc.sendConnect(); err != nil {
+		return err
+	}
+	return rc.waitConnected(reconnectTimeout)
+}
+
+func (rc *RemoteClient) waitConnected(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if rc.isStopped() {
+			return fmt.Errorf("Stopped")
+		}
+		if peerConn := rc.getPeerConn(); peerConn != nil && peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Timed out waiting for the connection")
+}
+
+// Ask the host to relay through the signaling server if the peer connection isn't connected after relayTimeout
+func (rc *RemoteClient) relayIfNotConnected() {
+	select {
+	case <-rc.done:
+		return
+	case <-time.After(rc.relayTimeout):
+	}
+	if rc.isRelaying() {
+		return
+	}
+	if peerConn := rc.getPeerConn(); peerConn != nil && peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
+		return
+	}
+
+	private, public, err := newRelayKey()
+	if err != nil {
+		log.Printf("Failed to create relay key: %s", err)
+		return
+	}
+	rc.lock.Lock()
+	rc.relayKey = private
+	rc.lock.Unlock()
+
+	log.Printf("Peer connection is not connected after %s, asking the host to relay", rc.relayTimeout)
+	rc.showStatus("Can't connect directly, relaying through the signaling server...")
+	if err := rc.writeWebsocket(message.Wrapper{Type: message.TCRelay, Data: public}); err != nil {
+		rc.Stop(fmt.Sprintf("Failed to connect to termishare session: %s", err))
+	}
+}
+
+// The host answered our relay request with its public key, or an empty one if it refuses to relay
+func (rc *RemoteClient) startRelay(msg message.Wrapper) error {
+	hostPublic, _ := msg.Data.(string)
+	rc.lock.Lock()
+	private, relaying := rc.relayKey, rc.relay != nil
+	rc.lock.Unlock()
+	if relaying && hostPublic == "" {
+		// the host dropped us, lost data or idle
+		rc.Stop("The host stopped relaying through the signaling server")
+		return nil
+	}
+	if private == nil {
+		return fmt.Errorf("Relay answer without a relay request")
+	}
+	if hostPublic == "" {
+		rc.Stop("Failed to connect to termishare session: can't connect directly and the host doesn't relay through the signaling server")
+		return nil
+	}
+
+	r, err := newRelay(private, hostPublic, false, rc.sessionID, rc.writeWebsocketWait)
+	if err != nil {
+		rc.Stop(fmt.Sprintf("Failed to relay through the signaling server: %s", err))
+		return err
+	}
+	rc.lock.Lock()
+	rc.relay = r
+	rc.relayKey = nil
+	peerConn := rc.peerConn
+	rc.lock.Unlock()
+
+	// a closed peer connection isn't reconnected
+	if peerConn != nil {
+		peerConn.Close()
+	}
+	log.Printf("Relaying through the signaling server")
+	rc.showStatus("Relayed through the signaling server")
+	rc.notify(Event{Type: EventRelayed})
+
+	// the host drops relayed clients it doesn't hear from
+	go func() {
+		ticker := time.NewTicker(relayKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rc.done:
+				return
+			case <-ticker.C:
+				if err := rc.sendConfig(message.Wrapper{Type: message.TRTTPing, Data: "keepalive"}); err != nil {
+					log.Printf("Failed to send keepalive: %s", err)
+				}
 			}
 		}
 	}()
-
-	// Wait
-	<-rc.done
-	return
+	return nil
 }
 
-func (rc *RemoteClient) sendOffer() {
+// Ask the host to join the session
+func (rc *RemoteClient) sendConnect() error {
+	if err := rc.writeWebsocket(message.Wrapper{Type: message.TCConnect, Data: cfg.TERMISHARE_VERSION}); err != nil {
+		return err
+	}
+	if rc.viewOnly {
+		return rc.writeWebsocket(message.Wrapper{Type: message.TCViewer})
+	}
+	return nil
+}
 
-	offer, err := rc.peerConn.CreateOffer(nil)
+func (rc *RemoteClient) sendOffer(options *webrtc.OfferOptions) error {
+	peerConn := rc.getPeerConn()
+	offer, err := peerConn.CreateOffer(options)
 	if err != nil {
-		log.Printf("Failed to create offer :%s", err)
-		rc.Stop("Failed to connect to termishare session")
+		return fmt.Errorf("Failed to create offer :%s", err)
 	}
 
-	err = rc.peerConn.SetLocalDescription(offer)
+	err = peerConn.SetLocalDescription(offer)
 	if err != nil {
-		log.Printf("Failed to set local description: %s", err)
-		rc.Stop("Failed to connect to termishare session")
+		return fmt.Errorf("Failed to set local description: %s", err)
 	}
 
+	offer.SDP = rc.icePolicy.filterSDP(offer.SDP)
 	offerByte, _ := json.Marshal(offer)
 	payload := message.Wrapper{
 		Type: message.TRTCOffer,
 		Data: string(offerByte),
 	}
 
-	rc.writeWebsocket(payload)
+	return rc.writeWebsocket(payload)
 }
 
+// Handle a message from the host, received from the signaling server or, without one, from the config channel
 func (rc *RemoteClient) handleWebSocketMessage(msg message.Wrapper) error {
+	// the host announces itself to everyone when it connects, it's only for clients that are still waiting:
+	// answering it once joined would replace a working peer connection
+	if msg.To == "" && rc.hasJoined() {
+		switch msg.Type {
+		case message.TCNoPasscode, message.TCRequirePasscode, message.TCAuthenticated:
+			return nil
+		}
+	}
+
 	switch msgType := msg.Type; msgType {
 
 	case message.TCUnsupportedVersion:
 		rc.Stop(fmt.Sprintf("The host require termishare version: %s and you're running %s. Please upgrade it! (github.com/qnkhuat/termishare)", msg.Data, cfg.TERMISHARE_VERSION))
 
 	case message.TCUnauthenticated:
-		fmt.Printf("Incorrect passcode!\n")
+		if rc.hasJoined() {
+			rc.Stop("The host no longer accepts the passcode")
+			return nil
+		}
+		if rc.passcodeGiven {
+			rc.Stop("Incorrect passcode!")
+			return nil
+		}
+		if rc.passcodeAttempts >= maxPasscodeAttempts {
+			rc.Stop(fmt.Sprintf("Incorrect passcode, giving up after %d attempts", rc.passcodeAttempts))
+			return nil
+		}
+		if !rc.headless() {
+			fmt.Printf("Incorrect passcode!\n")
+		}
 		fallthrough
+
 	case message.TCRequirePasscode:
-		fmt.Printf("Passcode: ")
-		passcode, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-		passcode = strings.TrimSpace(passcode)
-		resp := message.Wrapper{
-			Type: message.TCPasscode,
-			Data: passcode,
+		// when reconnecting, use the passcode that was accepted before
+		if !rc.passcodeGiven && !rc.hasJoined() {
+			passcode, err := rc.askPasscode()
+			if err != nil {
+				rc.Stop(fmt.Sprintf("The session requires a passcode: %s", err))
+				return nil
+			}
+			rc.passcode = passcode
+			rc.passcodeAttempts++
 		}
-		rc.writeWebsocket(resp)
+		rc.sendSignal(message.Wrapper{Type: message.TCPasscode, Data: rc.passcode})
 
 	case message.TCNoPasscode, message.TCAuthenticated:
-		rc.connected = true
-		rc.sendOffer()
+		if msg.Type == message.TCAuthenticated && !rc.hasJoined() {
+			rc.notify(Event{Type: EventAuthenticated})
+		}
+		// without signaling, we're already connected
+		if rc.manual {
+			rc.markJoined()
+			return nil
+		}
+		hostICEServers, err := iceServersFromMessage(msg)
+		if err != nil {
+			log.Printf("Failed to read the host's ICE servers: %s", err)
+		}
+		if err := rc.newPeerConnection(hostICEServers); err != nil {
+			log.Printf("Failed to create peer connetion : %s", err)
+			if !rc.hasJoined() {
+				rc.Stop("Failed to connect to termishare session")
+			}
+			return err
+		}
+		if err := rc.sendOffer(nil); err != nil {
+			if !rc.hasJoined() {
+				rc.Stop("Failed to connect to termishare session")
+			}
+			return err
+		}
+		if rc.relayTimeout > 0 {
+			go rc.relayIfNotConnected()
+		}
+		rc.markJoined()
+
+	case message.TCRelay:
+		return rc.startRelay(msg)
+
+	case message.TCRelayData:
+		r := rc.getRelay()
+		if r == nil {
+			return fmt.Errorf("Relayed message before relaying")
+		}
+		channel, data, err := r.receive(msg)
+		if errors.Is(err, errRelayGap) {
+			rc.Stop("Lost data relayed through the signaling server")
+			return err
+		} else if err != nil {
+			return err
+		}
+		switch channel {
+		case cfg.TERMISHARE_WEBRTC_DATA_CHANNEL:
+			rc.handleData(webrtc.DataChannelMessage{Data: data})
+		case cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL:
+			rc.handleConfigMessage(webrtc.DataChannelMessage{IsString: true, Data: data})
+		}
 
 	case message.TRTCOffer:
 		return fmt.Errorf("Remote client shouldn't receive Offer message")
@@ -301,7 +768,11 @@ func (rc *RemoteClient) handleWebSocketMessage(msg message.Wrapper) error {
 			return err
 		}
 
-		rc.peerConn.SetRemoteDescription(answer)
+		peerConn := rc.getPeerConn()
+		if peerConn == nil {
+			return fmt.Errorf("Received an answer before creating a peer connection")
+		}
+		return peerConn.SetRemoteDescription(answer)
 
 	case message.TRTCCandidate:
 		candidate := webrtc.ICECandidateInit{}
@@ -309,7 +780,11 @@ func (rc *RemoteClient) handleWebSocketMessage(msg message.Wrapper) error {
 			return fmt.Errorf("Failed to unmarshall icecandidate: %s", err)
 		}
 
-		if err := rc.peerConn.AddICECandidate(candidate); err != nil {
+		peerConn := rc.getPeerConn()
+		if peerConn == nil {
+			return fmt.Errorf("Received a candidate before creating a peer connection")
+		}
+		if err := peerConn.AddICECandidate(candidate); err != nil {
 			return fmt.Errorf("Failed to add ice candidate: %s", err)
 		}
 
@@ -324,45 +799,178 @@ func (rc *RemoteClient) handleWebSocketMessage(msg message.Wrapper) error {
 	return nil
 }
 
-func (rc *RemoteClient) Stop(msg string) {
-	log.Printf("Stop: %s", msg)
+// The host accepted us and the peer connection is being set up, join returns
+func (rc *RemoteClient) markJoined() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if !rc.connected {
+		rc.connected = true
+		close(rc.joined)
+	}
+}
 
-	if rc.wsConn != nil {
-		rc.wsConn.WriteControl(websocket.CloseMessage, []byte{}, time.Time{})
-		rc.wsConn.Close()
-		rc.wsConn = nil
+// Send a message to the host through the signaling server, or the config channel without one
+func (rc *RemoteClient) sendSignal(msg message.Wrapper) error {
+	if rc.manual {
+		return rc.sendConfig(msg)
 	}
+	return rc.writeWebsocket(msg)
+}
 
-	if rc.peerConn != nil {
-		rc.peerConn.Close()
-		rc.peerConn = nil
+// Ask for the passcode on the terminal without echoing it, or the Session's AskPasscode
+func (rc *RemoteClient) askPasscode() (string, error) {
+	if rc.session != nil {
+		incorrect := rc.passcodeAttempts > 0
+		reason := ""
+		if incorrect {
+			reason = "Incorrect passcode"
+		}
+		rc.notify(Event{Type: EventPasscodeRequired, Reason: reason})
+		if rc.askSessionPasscode == nil {
+			return "", fmt.Errorf("no passcode given")
+		}
+		return rc.askSessionPasscode(incorrect)
 	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("stdin is not a terminal to ask for it")
+	}
+	fmt.Printf("Passcode: ")
+	passcode, err := term.ReadPassword(fd)
+	fmt.Println()
+	return strings.TrimSpace(string(passcode)), err
+}
+
+func (rc *RemoteClient) Stop(msg string) {
+	rc.stopOnce.Do(func() {
+		log.Printf("Stop: %s", msg)
+
+		rc.lock.Lock()
+		rc.stopped = true
+		rc.stopReason = msg
+		wsConn, peerConn := rc.wsConn, rc.peerConn
+		rc.lock.Unlock()
+
+		if wsConn != nil {
+			wsConn.WriteControl(websocket.CloseMessage, []byte{}, time.Time{})
+			wsConn.Close()
+		}
 
-	if rc.pty != nil {
-		rc.pty.Restore()
-		rc.pty = nil
+		if peerConn != nil {
+			peerConn.Close()
+		}
+
+		if rc.pty != nil {
+			rc.pty.Restore()
+		}
+
+		if rc.recorder != nil {
+			if err := rc.recorder.Close(); err != nil {
+				log.Printf("Failed to close recording: %s", err)
+			}
+		}
+
+		if rc.session != nil {
+			rc.session.close(msg)
+		} else if rc.exec != nil {
+			// stdout only has the command's output
+			if msg != "" {
+				fmt.Fprintln(os.Stderr, msg)
+			}
+		} else {
+			clearScreen()
+			fmt.Println(msg)
+		}
+		close(rc.done)
+	})
+}
+
+// Diagnostics of the connection to the host, measuring the round trip time takes up to a few seconds
+func (rc *RemoteClient) Diagnostics() Diagnostics {
+	d := collectDiagnostics(rc.getPeerConn())
+	if rc.getRelay() != nil {
+		d = Diagnostics{State: "relayed", SignalingRelay: true}
+	}
+	if rtt, err := rc.rtt.measure(rc.sendConfig); err == nil {
+		d.RTT = rtt
+	} else {
+		log.Printf("Failed to measure round trip time: %s", err)
 	}
+	return d
+}
 
-	clearScreen()
-	fmt.Println(msg)
-	rc.done <- true
-	return
+// Whether the client runs without drawing to the terminal, in exec mode or as a library
+func (rc *RemoteClient) headless() bool {
+	return rc.exec != nil || rc.session != nil
+}
+
+// Send an event to the Session using this client, if any
+func (rc *RemoteClient) notify(event Event) {
+	if rc.session != nil {
+		rc.session.emit(event)
+	}
+}
+
+func (rc *RemoteClient) stopError() error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return errors.New(rc.stopReason)
+}
+
+func (rc *RemoteClient) isStopped() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.stopped
+}
+
+// whether the host accepted us at least once
+func (rc *RemoteClient) hasJoined() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.connected
+}
+
+func (rc *RemoteClient) getPeerConn() *webrtc.PeerConnection {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.peerConn
+}
+
+func (rc *RemoteClient) getRelay() *relay {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.relay
+}
+
+// whether we asked the host to relay, or it does
+func (rc *RemoteClient) isRelaying() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.relayKey != nil || rc.relay != nil
+}
+
+func (rc *RemoteClient) getWebSocket() *WebSocket {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.wsConn
 }
 
 func (rc *RemoteClient) maybeNeedResize() {
+	if rc.headless() {
+		// nothing is drawn
+		return
+	}
 	if (rc.winSizes.remoteCols == 0 && rc.winSizes.remoteRows == 0) || (rc.winSizes.thisCols == 0 && rc.winSizes.thisRows == 0) {
 		// not iniated
 		return
 	}
 
 	if rc.winSizes.thisRows < rc.winSizes.remoteRows || rc.winSizes.thisCols < rc.winSizes.remoteCols {
-		rc.muteDisplay = true
+		// show the part of the host's screen that fits
 		clearScreen()
-		fmt.Printf("\n\rYour terminal is smaller than the host's terminal\n\r"+
-			"Please resize or press 'Ctrl-x + Ctrl-x' to exit\n\rHost's terminal: %dx%d\n\rYour terminal: %dx%d\n\r",
-			rc.winSizes.remoteCols, rc.winSizes.remoteRows, rc.winSizes.thisCols, rc.winSizes.thisRows)
+		rc.setViewportEnabled(true)
 	} else {
-		rc.muteDisplay = false
+		rc.setViewportEnabled(false)
 		clearScreen()
 		err := rc.requestRemoteRefresh()
 		if err != nil {
@@ -376,24 +984,66 @@ func (rc *RemoteClient) requestRemoteRefresh() error {
 }
 
 func (rc *RemoteClient) sendConfig(msg message.Wrapper) error {
-	if rc.configChannel != nil {
+	rc.lock.Lock()
+	configChannel, relay := rc.configChannel, rc.relay
+	rc.lock.Unlock()
+	if relay != nil {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return rc.relaySend(relay, cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL, payload)
+	} else if configChannel != nil {
 		payload, err := json.Marshal(msg)
 		if err != nil {
 			return err
 		}
-		return rc.configChannel.Send(payload)
+		return configChannel.Send(payload)
 	} else {
 		return fmt.Errorf("Config channel not existed")
 	}
 }
 
+func (rc *RemoteClient) sendData(data []byte) error {
+	rc.lock.Lock()
+	dataChannel, relay := rc.dataChannel, rc.relay
+	rc.lock.Unlock()
+	if relay != nil {
+		return rc.relaySend(relay, cfg.TERMISHARE_WEBRTC_DATA_CHANNEL, data)
+	}
+	if dataChannel == nil {
+		return fmt.Errorf("Data channel not existed")
+	}
+	return dataChannel.Send(data)
+}
+
 func (rc *RemoteClient) writeWebsocket(msg message.Wrapper) error {
 	msg.To = cfg.TERMISHARE_WEBSOCKET_HOST_ID
 	msg.From = rc.clientID
-	if rc.wsConn == nil {
+	wsConn := rc.getWebSocket()
+	if wsConn == nil {
 		return fmt.Errorf("Websocket not connected")
 	}
-	rc.wsConn.Out <- msg
+	return wsConn.Send(msg)
+}
+
+// Like writeWebsocket, but waits for room in the send buffer instead of dropping the message
+func (rc *RemoteClient) writeWebsocketWait(msg message.Wrapper) error {
+	msg.To = cfg.TERMISHARE_WEBSOCKET_HOST_ID
+	msg.From = rc.clientID
+	wsConn := rc.getWebSocket()
+	if wsConn == nil {
+		return fmt.Errorf("Websocket not connected")
+	}
+	return wsConn.SendWait(msg, relaySendTimeout)
+}
+
+// Send through the relay, the host would see a gap after a failed send so the session ends
+func (rc *RemoteClient) relaySend(r *relay, channel string, data []byte) error {
+	if err := r.send(channel, data); err != nil {
+		rc.Stop(fmt.Sprintf("Failed to relay through the signaling server: %s", err))
+		return err
+	}
 	return nil
 }
 
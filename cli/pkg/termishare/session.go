@@ -0,0 +1,182 @@
+// Session is the library way to join a termishare session: what the host's terminal prints is read from it,
+// and what is written to it is typed in the host's terminal
+// Nothing is printed and the local terminal is never touched, so it can be used to build bots, tests or other frontends
+package termishare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/qnkhuat/termishare/pkg/vt"
+)
+
+// events are dropped if the channel is full
+const sessionEventBufferSize = 64
+
+type DialOptions struct {
+	// the passcode of the session, if it's wrong Dial fails
+	Passcode string
+	// called when the session requires a passcode and Passcode is empty, incorrect is true after a wrong passcode
+	AskPasscode func(incorrect bool) (string, error)
+	// never type in the host's terminal, and tell the host so
+	ViewOnly bool
+	// STUN and TURN servers, used along the ones the host sends. The default ones if nil
+	ICEServers []webrtc.ICEServer
+	// never use a TURN server, not even the host's ones
+	NoTURN    bool
+	ICEPolicy ICEPolicy
+	// see Options.Proxy
+	Proxy string
+	// TLS and authentication for a private signaling server
+	Signaling SignalingOptions
+	// fail instead of relaying through the signaling server when the peer connection can't connect
+	// Relaying is only safe with a trusted server: a malicious one can get in the middle of the relay's key exchange
+	NoRelay bool
+}
+
+type Session struct {
+	rc *RemoteClient
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// received from the host and not read yet
+	buf    bytes.Buffer
+	closed bool
+	events chan Event
+}
+
+// Join a session, ctx only bounds connecting to it, use Close to leave
+func Dial(ctx context.Context, server string, sessionID string, opts DialOptions) (*Session, error) {
+	s := &Session{events: make(chan Event, sessionEventBufferSize)}
+	s.cond = sync.NewCond(&s.lock)
+
+	rc := NewRemoteClient()
+	rc.session = s
+	rc.askSessionPasscode = opts.AskPasscode
+	if opts.Passcode != "" {
+		rc.SetPasscode(opts.Passcode)
+	}
+	rc.SetViewOnly(opts.ViewOnly)
+	if opts.ICEServers != nil {
+		rc.SetICEServers(opts.ICEServers)
+	}
+	rc.SetNoTURN(opts.NoTURN)
+	rc.SetICEPolicy(opts.ICEPolicy)
+	rc.SetProxy(opts.Proxy)
+	rc.SetSignalingOptions(opts.Signaling)
+	if opts.NoRelay {
+		rc.SetRelayTimeout(0)
+	}
+	// keep a model of the host's screen for Screen
+	rc.screen = vt.New(80, 24)
+	s.rc = rc
+
+	if err := rc.join(ctx, server, sessionID); err != nil {
+		if ctx.Err() != nil {
+			rc.Stop(fmt.Sprintf("Failed to connect: %s", ctx.Err()))
+			return nil, rc.stopError()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read what the host's terminal prints, returns io.EOF once the session is over and everything was read
+func (s *Session) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.buf.Len() == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return s.buf.Read(p)
+}
+
+// Type in the host's terminal
+func (s *Session) Write(p []byte) (int, error) {
+	if s.rc.viewOnly {
+		return 0, fmt.Errorf("Session joined as a viewer")
+	}
+	if s.rc.isStopped() {
+		return 0, io.ErrClosedPipe
+	}
+	for i := 0; i < len(p); i += maxInputMessageSize {
+		end := i + maxInputMessageSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.rc.sendData(p[i:end]); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// Leave the session
+func (s *Session) Close() error {
+	s.rc.Stop("Session closed")
+	return nil
+}
+
+// Tell the host the frontend was resized to cols x rows so it redraws its terminal
+// The host's terminal keeps its own size, see HostSize
+func (s *Session) Resize(cols, rows int) error {
+	s.rc.winSizes.thisCols = uint16(cols)
+	s.rc.winSizes.thisRows = uint16(rows)
+	return s.rc.requestRemoteRefresh()
+}
+
+// Size of the host's terminal, 0 until the host sent it
+func (s *Session) HostSize() (int, int) {
+	return int(s.rc.winSizes.remoteCols), int(s.rc.winSizes.remoteRows)
+}
+
+// Events of the session, closed when the session is over
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+// A model of the host's screen, updated as output is received
+func (s *Session) Screen() *vt.Screen {
+	return s.rc.screen
+}
+
+func (s *Session) Diagnostics() Diagnostics {
+	return s.rc.Diagnostics()
+}
+
+func (s *Session) receive(data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buf.Write(data)
+	s.cond.Broadcast()
+}
+
+func (s *Session) emit(event Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		log.Printf("Dropped session event: %v", event)
+	}
+}
+
+func (s *Session) close(reason string) {
+	s.emit(Event{Type: EventDisconnected, Reason: reason})
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	close(s.events)
+	s.cond.Broadcast()
+}
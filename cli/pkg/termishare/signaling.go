@@ -0,0 +1,75 @@
+package termishare
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// How to connect to a private signaling server
+// The zero value is the system's CAs and no authentication
+type SignalingOptions struct {
+	// PEM file of the CAs to trust instead of the system's ones
+	CAFile string
+	// client certificate and its key, PEM files, for servers that require mTLS
+	CertFile string
+	KeyFile  string
+	// don't verify the server's certificate, only for development
+	InsecureSkipVerify bool
+	// sent as "Authorization: Bearer <Token>"
+	Token string
+	// more headers sent when connecting, e.g. X-Api-Key
+	Header http.Header
+}
+
+// Parse a header like "X-Api-Key: secret"
+func ParseHeader(header string) (string, string, error) {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", fmt.Errorf("Invalid header: %s, expected Name: value", header)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+func (o SignalingOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		data, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificate found in CA file %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("A client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Headers of the websocket handshake
+func (o SignalingOptions) header() http.Header {
+	header := http.Header{}
+	for name, values := range o.Header {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	if o.Token != "" {
+		header.Set("Authorization", "Bearer "+o.Token)
+	}
+	return header
+}
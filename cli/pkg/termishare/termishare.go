@@ -2,7 +2,9 @@ package termishare
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,6 +20,7 @@ import (
 	"github.com/qnkhuat/termishare/internal/cfg"
 	"github.com/qnkhuat/termishare/pkg/message"
 	"github.com/qnkhuat/termishare/pkg/pty"
+	"github.com/qnkhuat/termishare/pkg/recording"
 )
 
 type Client struct {
@@ -30,6 +33,17 @@ type Client struct {
 	conn *webrtc.PeerConnection
 
 	authenticated bool
+
+	// the client declared it only watches, anything it sends to the terminal is dropped
+	viewer bool
+	// joined with ManualOffer, it authenticates over the config channel
+	manual bool
+	// set once the channels are relayed through the signaling server, see relay.go
+	relay *relay
+	// ICE servers of the peer connection, sent to the client, with TURN credentials minted for it
+	iceServers []webrtc.ICEServer
+
+	rtt rttProbe
 }
 
 type Termishare struct {
@@ -37,133 +51,466 @@ type Termishare struct {
 
 	// Used for singnaling
 	wsConn *WebSocket
+	// set by Stop so the signaling connection isn't reopened
+	stopping bool
 
 	clients map[string]*Client
 	lock    sync.RWMutex
 
-	// config
-	noTurn bool
+	opts      Options
+	sessionID string
 
 	// if empty, session does not require passcode
 	passcode string
+
+	// if set, everything written to the terminal is recorded
+	recorder *recording.Writer
+
+	events       chan Event
+	eventsLock   sync.Mutex
+	eventsClosed bool
+	done         chan bool
+	// closed once the command is started
+	started    chan bool
+	stopOnce   sync.Once
+	stopReason string
+
+	// resize the shared terminal with the terminal termishare runs in
+	followTerminal bool
+	passcodePolicy PasscodePolicy
+}
+
+type Options struct {
+	// address of the signaling server
+	Server string
+	// don't use a signaling server, a client joins with ManualOffer and AcceptManualAnswer
+	Manual bool
+	// STUN and TURN servers, the default ones if nil. Clients are told to use them too
+	ICEServers []webrtc.ICEServer
+	// if set, gives the TURN servers of ICEServers new credentials each time a client joins,
+	// see MintTURNCredentials and EndpointTURNCredentials
+	TURNCredentials TURNCredentialsFunc
+	// which candidates are gathered and sent to clients
+	ICEPolicy ICEPolicy
+	// proxy to the signaling server and TURN servers over TCP and TLS, like http://proxy:3128 or socks5://proxy:1080
+	// if empty it's taken from HTTPS_PROXY, HTTP_PROXY or ALL_PROXY, ProxyDirect to not use one
+	Proxy string
+	// TLS and authentication for a private signaling server
+	Signaling SignalingOptions
+	// refuse to relay through the signaling server, clients that can't connect directly or through TURN can't join
+	// Relaying is only safe with a trusted server: a malicious one can get in the middle of the relay's key exchange
+	NoRelay bool
+	// if empty, session does not require passcode
+	Passcode string
+	// the command to share and its arguments, $SHELL by default
+	Command []string
+	// extra environment variables for the command
+	Env []string
+	// size of the shared terminal, 80x24 by default
+	Cols int
+	Rows int
+	// optional, what the user types in the shared terminal, and where it prints to
+	Stdin  io.Reader
+	Stdout io.Writer
+}
+
+// events are dropped if the channel is full
+const hostEventBufferSize = 64
+
+// Used by the termishare command, see NewWithOptions to use it as a library
+// iceServers are also sent to clients, so they can use the same TURN servers
+func New(iceServers []webrtc.ICEServer) *Termishare {
+	opts := Options{ICEServers: iceServers, Stdin: os.Stdin, Stdout: os.Stdout}
+	if ws, err := pty.GetWinsize(0); err == nil {
+		opts.Cols = int(ws.Cols)
+		opts.Rows = int(ws.Rows)
+	}
+	ts, _ := NewWithOptions(opts)
+	return ts
+}
+
+// A session to share a command, start it with Run
+// Nothing is printed and the terminal termishare runs in is not used unless Stdin or Stdout are set
+func NewWithOptions(opts Options) (*Termishare, error) {
+	if opts.ICEServers == nil {
+		opts.ICEServers = DefaultICEServers()
+	}
+	if len(opts.Command) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "bash"
+		}
+		opts.Command = []string{shell}
+	}
+	if opts.Cols <= 0 || opts.Rows <= 0 {
+		opts.Cols, opts.Rows = 80, 24
+	}
+
+	ts := &Termishare{
+		pty:       pty.New(),
+		clients:   make(map[string]*Client),
+		opts:      opts,
+		sessionID: uuid.NewString(),
+		events:    make(chan Event, hostEventBufferSize),
+		done:      make(chan bool),
+		started:   make(chan bool),
+	}
+	if opts.Passcode != "" {
+		if err := ts.SetPasscode(opts.Passcode); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
 }
 
-func New(noTurn bool) *Termishare {
-	return &Termishare{
-		pty:     pty.New(),
-		clients: make(map[string]*Client),
-		noTurn:  noTurn,
+func (ts *Termishare) SessionID() string {
+	return ts.sessionID
+}
+
+// Where clients can join the session
+func (ts *Termishare) URL() string {
+	return sessionURL(ts.opts.Server, ts.sessionID)
+}
+
+// Clients joining and leaving, and errors. Closed when the session is over
+func (ts *Termishare) Events() <-chan Event {
+	return ts.events
+}
+
+// Record the session to w, must be called before Start
+func (ts *Termishare) Record(w io.Writer) error {
+	header := recording.Header{
+		Width:  ts.opts.Cols,
+		Height: ts.opts.Rows,
+		Env:    map[string]string{"SHELL": ts.opts.Command[0], "TERM": os.Getenv("TERM")},
+	}
+
+	recorder, err := recording.NewWriter(w, header)
+	if err != nil {
+		return err
 	}
+	ts.recorder = recorder
+	return nil
+}
+
+// Whether Start asks for a passcode
+type PasscodePolicy string
+
+const (
+	// ask for a passcode when starting, enter to disable it
+	PasscodeAsk PasscodePolicy = "ask"
+	// ask for a passcode when starting, it can't be empty
+	PasscodeRequired PasscodePolicy = "required"
+	// don't ask, the session has no passcode
+	PasscodeNone PasscodePolicy = "none"
+)
+
+// Parse ask, required or none
+func ParsePasscodePolicy(policy string) (PasscodePolicy, error) {
+	switch p := PasscodePolicy(policy); p {
+	case PasscodeAsk, PasscodeRequired, PasscodeNone:
+		return p, nil
+	}
+	return "", fmt.Errorf("Invalid passcode policy: %s, expected ask, required or none", policy)
+}
+
+// Which candidates are gathered and sent to clients, must be called before Start
+func (ts *Termishare) SetICEPolicy(policy ICEPolicy) {
+	ts.opts.ICEPolicy = policy
+}
+
+// See Options.TURNCredentials
+func (ts *Termishare) SetTURNCredentials(credentials TURNCredentialsFunc) {
+	ts.opts.TURNCredentials = credentials
+}
+
+// See Options.Proxy
+func (ts *Termishare) SetProxy(proxy string) {
+	ts.opts.Proxy = proxy
+}
+
+// See Options.Signaling
+func (ts *Termishare) SetSignalingOptions(signaling SignalingOptions) {
+	ts.opts.Signaling = signaling
+}
+
+// See Options.NoRelay
+func (ts *Termishare) SetNoRelay(noRelay bool) {
+	ts.opts.NoRelay = noRelay
+}
+
+// Don't use a signaling server, Start prints an offer for a client and asks for its answer
+func (ts *Termishare) SetManual(manual bool) {
+	ts.opts.Manual = manual
+}
+
+// How Start sets the passcode, PasscodeAsk by default
+func (ts *Termishare) SetPasscodePolicy(policy PasscodePolicy) {
+	ts.passcodePolicy = policy
 }
 
+// Share the terminal termishare runs in, used by the termishare command
+// Asks for a passcode, prints where to join the session and blocks until the shell exits
 func (ts *Termishare) Start(server string) error {
-	// Create a pty to fake the terminal session
-	sessionID := uuid.NewString()
-	log.Printf("New session: %s", sessionID)
-	envVars := []string{fmt.Sprintf("%s=%s", cfg.TERMISHARE_ENVKEY_SESSIONID, sessionID)}
-	ts.pty.StartDefaultShell(envVars)
+	ts.opts.Server = server
 
 	// Set passcode
-	fmt.Printf("Set passcode (enter to disable passcode): ")
-	for {
-		passcode, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-		passcode = strings.TrimSpace(passcode)
-		// enter to set no passcode
-		if len(passcode) == 0 {
-			break
+	if ts.passcodePolicy != PasscodeNone {
+		prompt := "Set passcode (enter to disable passcode): "
+		if ts.passcodePolicy == PasscodeRequired {
+			prompt = "Set passcode: "
 		}
+		fmt.Print(prompt)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			passcode, err := reader.ReadString('\n')
+			if err != nil {
+				// e.g. stdin is closed, asking again won't help
+				err = fmt.Errorf("Failed to read passcode: %s", err)
+				fmt.Printf("\n%s\n", err)
+				return err
+			}
+			passcode = strings.TrimSpace(passcode)
+			// enter to set no passcode
+			if len(passcode) == 0 && ts.passcodePolicy != PasscodeRequired {
+				break
+			}
 
-		err := ts.SetPasscode(passcode)
-		if err != nil {
-			fmt.Printf("%s\n", err)
-			fmt.Printf("Set passcode (enter to disable passcode): ")
-		} else {
-			break
+			err = ts.SetPasscode(passcode)
+			if err != nil {
+				fmt.Printf("%s\n", err)
+				fmt.Print(prompt)
+			} else {
+				break
+			}
 		}
 	}
 
-	fmt.Printf("Sharing at: %s\n", GetClientURL(server, sessionID))
+	if ts.opts.Manual {
+		if err := ts.exchangeManually(); err != nil {
+			fmt.Printf("%s\n", err)
+			return err
+		}
+	} else {
+		fmt.Printf("Sharing at: %s\n", ts.URL())
+	}
 	fmt.Println("Type 'exit' or press 'Ctrl-D' to exit")
 	ts.pty.MakeRaw()
-	defer ts.Stop("Bye!")
+	ts.followTerminal = true
 
-	wsURL := GetWSURL(server, sessionID)
-	log.Printf("Connecting to: %s", wsURL)
-	wsConn, err := NewWebSocketConnection(wsURL)
+	err := ts.Run(context.Background())
+	ts.pty.Restore()
+	fmt.Println(ts.stopReason)
+	return err
+}
+
+// Share the command until it exits, ctx is canceled or Stop is called
+func (ts *Termishare) Run(ctx context.Context) error {
+	// Create a pty to fake the terminal session
+	log.Printf("New session: %s", ts.sessionID)
+	envVars := append(os.Environ(), fmt.Sprintf("%s=%s", cfg.TERMISHARE_ENVKEY_SESSIONID, ts.sessionID))
+	envVars = append(envVars, ts.opts.Env...)
+	err := ts.pty.StartWithSize(ts.opts.Command, envVars, &ptyDevice.Winsize{Cols: uint16(ts.opts.Cols), Rows: uint16(ts.opts.Rows)})
 	if err != nil {
+		ts.Stop(fmt.Sprintf("Failed to start %s", ts.opts.Command[0]))
+		return err
+	}
+	defer ts.Stop("Bye!")
+	close(ts.started)
+
+	if ts.followTerminal {
+		// Send a winsize message when ever terminal change size
+		ts.pty.SetWinChangeCB(ts.resized)
+	}
+
+	if !ts.opts.Manual {
+		if err := ts.connectSignaling(); err != nil {
+			return err
+		}
+	}
+
+	// Pipe command response to Pty and server
+	go func() {
+		// Write both to stdout and remote
+		writers := []io.Writer{ts}
+		if ts.opts.Stdout != nil {
+			writers = append(writers, ts.opts.Stdout)
+		}
+		if ts.recorder != nil {
+			writers = append(writers, ts.recorder)
+		}
+		mw := io.MultiWriter(writers...)
+		// fails once the command exits, which is handled below
+		_, err := io.Copy(mw, ts.pty.F())
+		if err != nil {
+			log.Printf("Failed to send pty to mw: %s", err)
+		}
+	}()
+
+	// Pipe what user type to terminal session
+	if ts.opts.Stdin != nil {
+		go func() {
+			_, err := io.Copy(ts.pty.F(), ts.opts.Stdin)
+			if err != nil {
+				log.Printf("Failed to send stdin to pty: %s", err)
+				ts.Stop("Failed to get user input\n")
+			}
+		}()
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- ts.pty.Wait() // Blocking until user exit
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-ts.done:
+		return nil
+	case <-ctx.Done():
+		ts.Stop("Canceled")
+		return ctx.Err()
+	}
+}
+
+// Connect to the signaling server and handle its messages
+// If the connection is lost later, clients stay connected and it's reconnected in the background
+func (ts *Termishare) connectSignaling() error {
+	if err := ts.dialSignaling(); err != nil {
 		log.Printf("Failed to connect to signaling server: %s", err)
-		ts.Stop("Failed to connect to signaling server")
+		ts.Stop(fmt.Sprintf("Failed to connect to signaling server: %s", err))
 		return err
 	}
 
-	ts.wsConn = wsConn
-	go wsConn.Start()
+	// tell clients already waiting whether they need a passcode, only once: not when reconnecting
+	announce := message.Wrapper{
+		Type: message.TCRequirePasscode,
+	}
+	if !ts.isRequirePasscode() {
+		announce.Type = message.TCNoPasscode
+		// the whole room gets it, TURN credentials are only sent to each client, see iceServersFor
+		announce.Data = WithoutTURN(ts.opts.ICEServers)
+	}
+	ts.writeWebsocket(announce)
 
 	// send a ping message to keep websocket alive, doesn't expect to receive anything
 	// This messages is expected to be broadcast to all client's connections so it keeps them alive too
 	go func() {
-		for range time.Tick(5 * time.Second) {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ts.done:
+				return
+			}
 			payload := message.Wrapper{
 				Type: message.TWSPing,
 				Data: []byte{},
 			}
 			ts.writeWebsocket(payload)
+			ts.removeIdleRelays()
 		}
 	}()
 
-	wsConn.SetPingHandler(func(appData string) error {
-		return wsConn.WriteControl(websocket.PongMessage, []byte{}, time.Time{})
-	})
-
-	wsConn.SetCloseHandler(func(code int, text string) error {
-		log.Printf("WebSocket connection closed with code %d :%s", code, text)
-		ts.Stop("WebSocket connection to server is closed")
-		return nil
-	})
+	go ts.keepSignaling()
+	return nil
+}
 
-	// require passcode
-	requirePasscodeMsg := message.Wrapper{
-		Type: message.TCRequirePasscode,
+// Open a connection to the signaling server with our session ID, so clients can join
+func (ts *Termishare) dialSignaling() error {
+	serverURL, err := ParseServerURL(ts.opts.Server)
+	if err != nil {
+		return err
 	}
-	if !ts.isRequirePasscode() {
-		requirePasscodeMsg.Type = message.TCNoPasscode
+	wsURL := serverURL.WebSocketURL(ts.sessionID)
+	log.Printf("Connecting to: %s", wsURL)
+	wsConn, err := NewWebSocketConnection(wsURL, ts.opts.Proxy, ts.opts.Signaling)
+	if err != nil {
+		return err
 	}
-	ts.writeWebsocket(requirePasscodeMsg)
-
-	go ts.startHandleWsMessages()
+	go wsConn.Start()
 
-	// Send a winsize message when ever terminal change size
-	ts.pty.SetWinChangeCB(func(ws *ptyDevice.Winsize) {
-		ts.broadcastConfig(message.Wrapper{
-			Type: message.TTermWinsize,
-			Data: message.Winsize{
-				Rows: ws.Rows,
-				Cols: ws.Cols},
-		})
-	})
+	ts.lock.Lock()
+	if ts.stopping {
+		ts.lock.Unlock()
+		wsConn.Close()
+		return fmt.Errorf("Session is stopped")
+	}
+	ts.wsConn = wsConn
+	ts.lock.Unlock()
+	return nil
+}
 
-	// Pipe command response to Pty and server
-	go func() {
-		// Write both to stdout and remote
-		mw := io.MultiWriter(os.Stdout, ts)
-		_, err := io.Copy(mw, ts.pty.F())
-		if err != nil {
-			log.Printf("Failed to send pty to mw: %s", err)
-			ts.Stop("Failed to connect pty with server\n")
+// Handle signaling messages and reconnect with backoff each time the connection is lost, until the session stops
+func (ts *Termishare) keepSignaling() {
+	for {
+		wsConn := ts.getWebSocket()
+		if wsConn == nil {
+			return
+		}
+		ts.handleWsMessages(wsConn)
+		if ts.isStopping() {
+			return
 		}
-	}()
 
-	// Pipe what user type to terminal session
-	go func() {
-		_, err := io.Copy(ts.pty.F(), os.Stdin)
-		if err != nil {
-			log.Printf("Failed to send stdin to pty: %s", err)
-			ts.Stop("Failed to get user input\n")
+		log.Printf("Lost connection to signaling server, reconnecting")
+		ts.emit(Event{Type: EventSignalingLost})
+		backoff := time.Second
+		for {
+			select {
+			case <-ts.done:
+				return
+			case <-time.After(backoff):
+			}
+			err := ts.dialSignaling()
+			if err == nil {
+				break
+			}
+			if ts.isStopping() {
+				return
+			}
+			log.Printf("Failed to reconnect to signaling server: %s", err)
+			backoff *= 2
+			if backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
 		}
-	}()
+		log.Printf("Reconnected to signaling server")
+		ts.emit(Event{Type: EventSignalingRestored})
+	}
+}
 
-	ts.pty.Wait() // Blocking until user exit
-	return nil
+func (ts *Termishare) isStopping() bool {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	return ts.stopping
+}
+
+func (ts *Termishare) getWebSocket() *WebSocket {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	return ts.wsConn
+}
+
+// Resize the shared terminal
+func (ts *Termishare) Resize(cols, rows int) {
+	ws := &ptyDevice.Winsize{Cols: uint16(cols), Rows: uint16(rows)}
+	ts.pty.SetWinsize(ws)
+	ts.resized(ws)
+}
+
+// Tell clients the terminal has a new size
+func (ts *Termishare) resized(ws *ptyDevice.Winsize) {
+	if ts.recorder != nil {
+		ts.recorder.Resize(int(ws.Cols), int(ws.Rows))
+	}
+	ts.broadcastConfig(message.Wrapper{
+		Type: message.TTermWinsize,
+		Data: message.Winsize{
+			Rows: ws.Rows,
+			Cols: ws.Cols},
+	})
 }
 
 func (ts *Termishare) SetPasscode(passcode string) error {
@@ -175,36 +522,66 @@ func (ts *Termishare) SetPasscode(passcode string) error {
 	}
 }
 
+// Stop sharing, msg tells why
 func (ts *Termishare) Stop(msg string) {
-	if ts.wsConn != nil {
-		ts.wsConn.WriteControl(websocket.CloseMessage, []byte{}, time.Time{})
-		ts.wsConn.Close()
+	ts.stopOnce.Do(func() {
+		log.Printf("Stop: %s", msg)
+		ts.stopReason = msg
+
+		// no more reconnecting to the signaling server
+		ts.lock.Lock()
+		wsConn := ts.wsConn
 		ts.wsConn = nil
-	}
+		ts.stopping = true
+		ts.lock.Unlock()
+		if wsConn != nil {
+			wsConn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Second))
+			wsConn.Close()
+		}
 
-	for _, client := range ts.clients {
-		client.conn.Close()
-	}
+		ts.lock.RLock()
+		for _, client := range ts.clients {
+			client.conn.Close()
+		}
+		ts.lock.RUnlock()
 
-	if ts.pty != nil {
 		ts.pty.Stop()
-		ts.pty.Restore()
-		ts.pty = nil
-	}
 
-	log.Printf("Stop: %s", msg)
-	fmt.Println(msg)
+		if ts.recorder != nil {
+			ts.recorder.Close()
+		}
+
+		close(ts.done)
+		ts.eventsLock.Lock()
+		ts.eventsClosed = true
+		close(ts.events)
+		ts.eventsLock.Unlock()
+	})
+}
+
+func (ts *Termishare) emit(event Event) {
+	ts.eventsLock.Lock()
+	defer ts.eventsLock.Unlock()
+	if ts.eventsClosed {
+		return
+	}
+	select {
+	case ts.events <- event:
+	default:
+		log.Printf("Dropped session event: %v", event)
+	}
 }
 
 // Blocking call to connect to a websocket server for signaling
-func (ts *Termishare) startHandleWsMessages() error {
-	if ts.wsConn == nil {
+// Handle the messages of a signaling connection until it's closed
+func (ts *Termishare) handleWsMessages(wsConn *WebSocket) error {
+	if wsConn == nil {
 		log.Printf("Websocket connection not initialized")
 		return fmt.Errorf("Websocket connection not initialized")
 	}
 
 	for {
-		msg, ok := <-ts.wsConn.In
+		msg, ok := <-wsConn.In
 		if !ok {
 			log.Printf("Failed to read websocket message")
 			return fmt.Errorf("Failed to read message from websocket")
@@ -219,6 +596,7 @@ func (ts *Termishare) startHandleWsMessages() error {
 		err := ts.handleWebSocketMessage(msg)
 		if err != nil {
 			log.Printf("Failed to handle message: %v, with error: %s", msg, err)
+			ts.emit(Event{Type: EventError, ClientID: msg.From, Err: err})
 			continue
 		}
 	}
@@ -233,11 +611,17 @@ func (ts *Termishare) handleWebSocketMessage(msg message.Wrapper) error {
 			ts.writeWebsocket(message.Wrapper{Type: message.TCUnsupportedVersion, Data: cfg.SUPPORTED_VERSION, To: msg.From})
 			return fmt.Errorf("Client is running unsupported version :%s", clientVersion)
 		}
-		_, err := ts.newClient(msg.From)
+		// a client reconnecting with a new peer connection
+		if ts.getClient(msg.From) != nil {
+			log.Printf("Client reconnected: %s", msg.From)
+			ts.removeClient(msg.From)
+		}
+		client, err := ts.newClient(msg.From)
 		log.Printf("New client with ID: %s", msg.From)
 		if err != nil {
 			return fmt.Errorf("Failed to create client: %s", err)
 		}
+		ts.emit(Event{Type: EventClientJoined, ClientID: msg.From})
 
 		msg := message.Wrapper{
 			To: msg.From,
@@ -246,14 +630,16 @@ func (ts *Termishare) handleWebSocketMessage(msg message.Wrapper) error {
 			msg.Type = message.TCRequirePasscode
 		} else {
 			msg.Type = message.TCNoPasscode
+			// clients connect with the same ICE servers as the host
+			msg.Data = client.iceServers
 		}
 
 		ts.writeWebsocket(msg)
 		return nil
 	}
 
-	client, ok := ts.clients[msg.From]
-	if !ok {
+	client = ts.getClient(msg.From)
+	if client == nil {
 		return fmt.Errorf("Client with ID: %s not found", msg.From)
 	}
 
@@ -284,6 +670,7 @@ func (ts *Termishare) handleWebSocketMessage(msg message.Wrapper) error {
 			return fmt.Errorf("Failed to set local description: %s", err)
 		}
 
+		answer.SDP = ts.opts.ICEPolicy.filterSDP(answer.SDP)
 		answerByte, _ := json.Marshal(answer)
 		payload := message.Wrapper{
 			Type: message.TRTCAnswer,
@@ -306,17 +693,38 @@ func (ts *Termishare) handleWebSocketMessage(msg message.Wrapper) error {
 			return fmt.Errorf("Failed to add ice candidate: %s", err)
 		}
 
+	case message.TCViewer:
+		ts.setViewer(msg.From, client)
+
+	case message.TCRelay:
+		return ts.acceptRelay(msg.From, client, msg)
+
+	case message.TCRelayData:
+		if client.relay == nil {
+			return fmt.Errorf("Relayed message before relaying")
+		}
+		channel, data, err := client.relay.receive(msg)
+		if errors.Is(err, errRelayGap) {
+			ts.dropRelay(msg.From, err)
+			return err
+		} else if err != nil {
+			return err
+		}
+		switch channel {
+		case cfg.TERMISHARE_WEBRTC_DATA_CHANNEL:
+			ts.handleClientInput(msg.From, client, data)
+		case cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL:
+			ts.handleClientConfig(msg.From, client, data)
+		}
+
 	case message.TCPasscode:
 		passcode := msg.Data.(string)
 		resp := message.Wrapper{
-			To: msg.From,
+			Type: ts.checkPasscode(msg.From, client, passcode),
+			To:   msg.From,
 		}
-
-		if ts.isAuthenticated(passcode) {
-			client.authenticated = true
-			resp.Type = message.TCAuthenticated
-		} else {
-			resp.Type = message.TCUnauthenticated
+		if resp.Type == message.TCAuthenticated {
+			resp.Data = client.iceServers
 		}
 		ts.writeWebsocket(resp)
 
@@ -330,11 +738,11 @@ func (ts *Termishare) handleWebSocketMessage(msg message.Wrapper) error {
 // shortcut to write to websocket connection
 func (ts *Termishare) writeWebsocket(msg message.Wrapper) error {
 	msg.From = cfg.TERMISHARE_WEBSOCKET_HOST_ID
-	if ts.wsConn == nil {
+	wsConn := ts.getWebSocket()
+	if wsConn == nil {
 		return fmt.Errorf("Websocket not connected")
 	}
-	ts.wsConn.Out <- msg
-	return nil
+	return wsConn.Send(msg)
 }
 
 func (ts *Termishare) broadcastConfig(msg message.Wrapper) error {
@@ -349,11 +757,14 @@ func (ts *Termishare) broadcastConfig(msg message.Wrapper) error {
 	defer ts.lock.RUnlock()
 	for ID, client := range ts.clients {
 		//go func(ID string, client *Client) {
-		if client.configChannel != nil {
+		var err error
+		if client.relay != nil {
+			client.relay.queue(cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL, payload)
+		} else if client.configChannel != nil {
 			err = client.configChannel.Send(payload)
-			if err != nil {
-				log.Printf("Failed to send config to client: %s :%s", ID, err)
-			}
+		}
+		if err != nil {
+			log.Printf("Failed to send config to client: %s :%s", ID, err)
 		}
 		//}(ID, client)
 	}
@@ -367,7 +778,10 @@ func (ts *Termishare) Write(data []byte) (int, error) {
 
 	for ID, client := range ts.clients {
 		//go func(ID string, client *Client) {
-		if client.termishareChannel != nil {
+		if client.relay != nil && ts.isAllowed(client) {
+			// sent in the background, a slow relayed client mustn't hold up the terminal
+			client.relay.queue(cfg.TERMISHARE_WEBRTC_DATA_CHANNEL, data)
+		} else if client.termishareChannel != nil && ts.isAllowed(client) {
 			err := client.termishareChannel.Send(data)
 			if err != nil {
 				log.Printf("Failed to send config to client: %s", ID)
@@ -379,9 +793,9 @@ func (ts *Termishare) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 func (ts *Termishare) removeClient(ID string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
 	if client, ok := ts.clients[ID]; ok {
-		ts.lock.Lock()
-		defer ts.lock.Unlock()
 		if client.configChannel != nil {
 			client.configChannel.Close()
 			client.configChannel = nil
@@ -396,31 +810,46 @@ func (ts *Termishare) removeClient(ID string) {
 			client.conn.Close()
 		}
 
+		if client.relay != nil {
+			client.relay.stopQueue()
+		}
+
 		delete(ts.clients, ID)
+		ts.emit(Event{Type: EventClientLeft, ClientID: ID})
 	}
 }
 
-func (ts *Termishare) newClient(ID string) (*Client, error) {
-	// Initiate peer connection
-	ICEServers := cfg.TERMISHARE_ICE_SERVER_STUNS
-	if !ts.noTurn {
-		ICEServers = append(ICEServers, cfg.TERMISHARE_ICE_SERVER_TURNS...)
+// ICE servers for a client joining, with new TURN credentials if Options.TURNCredentials is set
+// Without credentials, the client is left with STUN servers
+func (ts *Termishare) iceServersFor(ID string) []webrtc.ICEServer {
+	if ts.opts.TURNCredentials == nil {
+		return ts.opts.ICEServers
+	}
+	servers, err := ts.opts.TURNCredentials(ID, ts.opts.ICEServers)
+	if err != nil {
+		log.Printf("Failed to get TURN credentials for client %s: %s", ID, err)
+		ts.emit(Event{Type: EventError, ClientID: ID, Err: err})
+		return WithoutTURN(ts.opts.ICEServers)
 	}
+	return servers
+}
+
+func (ts *Termishare) newClient(ID string) (*Client, error) {
+	client := &Client{authenticated: false, iceServers: ts.iceServersFor(ID)}
 
+	// Initiate peer connection
 	var config = webrtc.Configuration{
-		ICEServers: ICEServers,
+		ICEServers: client.iceServers,
 	}
 
-	client := &Client{authenticated: false}
-
 	ts.lock.Lock()
 	ts.clients[ID] = client
 	ts.lock.Unlock()
 
-	peerConn, err := webrtc.NewPeerConnection(config)
+	peerConn, err := ts.opts.ICEPolicy.newPeerConnection(config, ts.opts.Proxy)
 
 	if err != nil {
-		fmt.Printf("Failed to create peer connection: %s", err)
+		log.Printf("Failed to create peer connection: %s", err)
 		return nil, err
 	}
 	client.conn = peerConn
@@ -428,72 +857,30 @@ func (ts *Termishare) newClient(ID string) (*Client, error) {
 	peerConn.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		log.Printf("Peer connection state has changed: %s", s.String())
 		switch s {
-		//case webrtc.PeerConnectionStateConnected:
-		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateDisconnected:
-			log.Printf("Removing client: %s", ID)
-			ts.removeClient(ID)
+		case webrtc.PeerConnectionStateConnected:
+			log.Printf("Client %s connected: %s", ID, collectDiagnostics(peerConn))
+		// a disconnected client could still come back with an ICE restart
+		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
+			// the client could have reconnected with the same ID, don't remove the new connection
+			// nor a client that gave up on the peer connection to relay through signaling
+			if ts.getClient(ID) == client && client.relay == nil {
+				log.Printf("Removing client: %s", ID)
+				ts.removeClient(ID)
+			}
 		}
 	})
 
 	peerConn.OnDataChannel(func(d *webrtc.DataChannel) {
-		log.Printf("New DataChannel %s %d\n", d.Label(), d.ID())
-
-		// Register channel opening handling
-		d.OnOpen(func() {
-			switch label := d.Label(); label {
-
-			case cfg.TERMISHARE_WEBRTC_DATA_CHANNEL:
-				d.OnMessage(func(msg webrtc.DataChannelMessage) {
-					ts.pty.Write(msg.Data)
-				})
-				ts.clients[ID].termishareChannel = d
-
-				// refresh terminal to sync make termishare send everything currently on terminal
-				ts.pty.Refresh()
-
-			case cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL:
-				d.OnMessage(func(webrtcMsg webrtc.DataChannelMessage) {
-
-					msg := &message.Wrapper{}
-					err := json.Unmarshal(webrtcMsg.Data, msg)
-					if err != nil {
-						log.Printf("Failed to read config message: %s", err)
-						return
-					}
-
-					log.Printf("Config channel got msg: %v", msg)
-					switch msg.Type {
-					case message.TTermRefresh:
-						ts.pty.Refresh()
-
-					default:
-						log.Printf("Unhandled msg config type: %s", msg.Type)
-					}
-
-				})
-				ts.clients[ID].configChannel = d
-
-				// send config at first to sync
-				ws, _ := pty.GetWinsize(0)
-				msg := message.Wrapper{
-					Type: message.TTermWinsize,
-					Data: message.Winsize{
-						Rows: ws.Rows,
-						Cols: ws.Cols}}
-				ts.broadcastConfig(msg)
-
-			default:
-				log.Printf("Unhandled data channel with label: %s", d.Label())
-			}
-		})
+		ts.setupDataChannel(ID, client, d)
 	})
 
 	peerConn.OnICECandidate(func(ice *webrtc.ICECandidate) {
-		if ice == nil {
+		// without signaling, candidates are in the offer
+		if ice == nil || ts.opts.Manual || !ts.opts.ICEPolicy.shareCandidate(ice) {
 			return
 		}
 
-		candidate, err := json.Marshal(ice.ToJSON())
+		candidate, err := json.Marshal(ts.opts.ICEPolicy.candidateInit(ice))
 		if err != nil {
 			log.Printf("Failed to decode ice candidate: %s", err)
 			return
@@ -511,12 +898,283 @@ func (ts *Termishare) newClient(ID string) (*Client, error) {
 	return client, nil
 }
 
+// Handle a data channel of a client, opened by the client or by us without signaling
+func (ts *Termishare) setupDataChannel(ID string, client *Client, d *webrtc.DataChannel) {
+	log.Printf("New DataChannel %s %d\n", d.Label(), d.ID())
+
+	// the client closed its peer connection, don't wait for ICE to notice
+	d.OnClose(func() {
+		if d.Label() == cfg.TERMISHARE_WEBRTC_DATA_CHANNEL && ts.getClient(ID) == client && client.relay == nil {
+			log.Printf("Data channel closed, removing client: %s", ID)
+			ts.removeClient(ID)
+		}
+	})
+
+	// Register channel opening handling
+	d.OnOpen(func() {
+		// without signaling, a client can connect before the command is started
+		select {
+		case <-ts.started:
+		case <-ts.done:
+			return
+		}
+
+		switch label := d.Label(); label {
+
+		case cfg.TERMISHARE_WEBRTC_DATA_CHANNEL:
+			d.OnMessage(func(msg webrtc.DataChannelMessage) {
+				ts.handleClientInput(ID, client, msg.Data)
+			})
+			client.termishareChannel = d
+
+			// refresh terminal to sync make termishare send everything currently on terminal
+			ts.pty.Refresh()
+
+		case cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL:
+			d.OnMessage(func(webrtcMsg webrtc.DataChannelMessage) {
+				ts.handleClientConfig(ID, client, webrtcMsg.Data)
+			})
+			client.configChannel = d
+
+			if client.manual {
+				if ts.isRequirePasscode() {
+					client.sendConfig(message.Wrapper{Type: message.TCRequirePasscode})
+				} else {
+					client.sendConfig(message.Wrapper{Type: message.TCNoPasscode})
+				}
+			}
+
+			// send config at first to sync
+			ws, err := ts.pty.Size()
+			if err != nil {
+				log.Printf("Failed to get winsize: %s", err)
+				return
+			}
+			msg := message.Wrapper{
+				Type: message.TTermWinsize,
+				Data: message.Winsize{
+					Rows: ws.Rows,
+					Cols: ws.Cols}}
+			ts.broadcastConfig(msg)
+
+		default:
+			log.Printf("Unhandled data channel with label: %s", d.Label())
+		}
+	})
+}
+
+// What a client types, from its data channel or relayed
+func (ts *Termishare) handleClientInput(ID string, client *Client, data []byte) {
+	if client.viewer || !ts.isAllowed(client) {
+		log.Printf("Dropped input from viewer or unauthenticated client: %s", ID)
+		return
+	}
+	ts.pty.Write(data)
+}
+
+// A message from the config channel of a client, or relayed
+func (ts *Termishare) handleClientConfig(ID string, client *Client, data []byte) {
+	msg := &message.Wrapper{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		log.Printf("Failed to read config message: %s", err)
+		return
+	}
+
+	log.Printf("Config channel got msg: %v", msg)
+	switch msg.Type {
+	case message.TTermRefresh:
+		ts.pty.Refresh()
+
+	case message.TRTTPing:
+		client.sendConfig(message.Wrapper{Type: message.TRTTPong, Data: msg.Data})
+
+	case message.TRTTPong:
+		client.rtt.pong(*msg)
+
+	// without signaling, the client joins over the config channel
+	case message.TCPasscode:
+		if !client.manual {
+			log.Printf("Ignored passcode from the config channel: %s", ID)
+			return
+		}
+		passcode, _ := msg.Data.(string)
+		client.sendConfig(message.Wrapper{Type: ts.checkPasscode(ID, client, passcode)})
+
+	case message.TCViewer:
+		if client.manual {
+			ts.setViewer(ID, client)
+		}
+
+	default:
+		log.Printf("Unhandled msg config type: %s", msg.Type)
+	}
+}
+
+// Relay the channels of a client through the signaling server, it gave up on the peer connection
+func (ts *Termishare) acceptRelay(ID string, client *Client, msg message.Wrapper) error {
+	if ts.opts.NoRelay {
+		ts.writeWebsocket(message.Wrapper{Type: message.TCRelay, To: ID})
+		return fmt.Errorf("Refused to relay client: %s", ID)
+	}
+	if !ts.isAllowed(client) {
+		return fmt.Errorf("Unauthenticated client")
+	}
+	clientPublic, _ := msg.Data.(string)
+	private, public, err := newRelayKey()
+	if err != nil {
+		return err
+	}
+	r, err := newRelay(private, clientPublic, true, ts.sessionID, func(msg message.Wrapper) error {
+		msg.To = ID
+		msg.From = cfg.TERMISHARE_WEBSOCKET_HOST_ID
+		wsConn := ts.getWebSocket()
+		if wsConn == nil {
+			return fmt.Errorf("Websocket not connected")
+		}
+		return wsConn.SendWait(msg, relaySendTimeout)
+	})
+	if err != nil {
+		return err
+	}
+	r.startQueue(func(err error) {
+		ts.dropRelay(ID, err)
+	})
+	if err := ts.writeWebsocket(message.Wrapper{Type: message.TCRelay, Data: public, To: ID}); err != nil {
+		r.stopQueue()
+		return err
+	}
+
+	ts.lock.Lock()
+	client.relay = r
+	ts.lock.Unlock()
+	if client.conn != nil {
+		client.conn.Close()
+	}
+	log.Printf("Relaying client %s through the signaling server", ID)
+	ts.emit(Event{Type: EventClientRelayed, ClientID: ID})
+
+	// like when the data channels open
+	select {
+	case <-ts.started:
+	case <-ts.done:
+		return nil
+	}
+	if ws, err := ts.pty.Size(); err == nil {
+		client.sendConfig(message.Wrapper{Type: message.TTermWinsize, Data: message.Winsize{Rows: ws.Rows, Cols: ws.Cols}})
+	}
+	ts.pty.Refresh()
+	return nil
+}
+
+// Remove relayed clients that stopped sending keep-alives, they can't be noticed leaving otherwise
+func (ts *Termishare) removeIdleRelays() {
+	ts.lock.RLock()
+	var idle []string
+	for ID, client := range ts.clients {
+		if client.relay != nil && client.relay.idle() > relayIdleTimeout {
+			idle = append(idle, ID)
+		}
+	}
+	ts.lock.RUnlock()
+	for _, ID := range idle {
+		ts.dropRelay(ID, fmt.Errorf("No message for %s", relayIdleTimeout))
+	}
+}
+
+// Remove a relayed client whose relay can't be used anymore, and tell it
+func (ts *Termishare) dropRelay(ID string, reason error) {
+	log.Printf("Removing relayed client %s: %s", ID, reason)
+	// an empty Relay message, like when refusing to relay
+	ts.writeWebsocket(message.Wrapper{Type: message.TCRelay, To: ID})
+	ts.removeClient(ID)
+}
+
+// Diagnostics of the connection to each client by ID, measuring round trip times takes up to a few seconds
+func (ts *Termishare) Diagnostics() map[string]Diagnostics {
+	ts.lock.RLock()
+	clients := make(map[string]*Client, len(ts.clients))
+	for ID, client := range ts.clients {
+		clients[ID] = client
+	}
+	ts.lock.RUnlock()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	diagnostics := make(map[string]Diagnostics, len(clients))
+	for ID, client := range clients {
+		wg.Add(1)
+		go func(ID string, client *Client) {
+			defer wg.Done()
+			d := client.Diagnostics()
+			lock.Lock()
+			diagnostics[ID] = d
+			lock.Unlock()
+		}(ID, client)
+	}
+	wg.Wait()
+	return diagnostics
+}
+
+func (c *Client) Diagnostics() Diagnostics {
+	d := collectDiagnostics(c.conn)
+	if c.relay != nil {
+		d = Diagnostics{State: "relayed", SignalingRelay: true}
+	}
+	if rtt, err := c.rtt.measure(c.sendConfig); err == nil {
+		d.RTT = rtt
+	}
+	return d
+}
+
+func (c *Client) sendConfig(msg message.Wrapper) error {
+	msg.From = cfg.TERMISHARE_WEBRTC_DATA_CHANNEL
+	if c.configChannel == nil && c.relay == nil {
+		return fmt.Errorf("Config channel not existed")
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if c.relay != nil {
+		// in order with the terminal's data, see relay.startQueue
+		c.relay.queue(cfg.TERMISHARE_WEBRTC_CONFIG_CHANNEL, payload)
+		return nil
+	}
+	return c.configChannel.Send(payload)
+}
+
 func (ts *Termishare) getClient(ID string) *Client {
 	ts.lock.RLock()
-	defer ts.lock.Unlock()
+	defer ts.lock.RUnlock()
 	return ts.clients[ID]
 }
 
+// Authenticate client if passcode is right, returns the answer to send it
+func (ts *Termishare) checkPasscode(ID string, client *Client, passcode string) message.MType {
+	if !ts.isAuthenticated(passcode) {
+		return message.TCUnauthenticated
+	}
+	client.authenticated = true
+	ts.emit(Event{Type: EventClientAuthenticated, ClientID: ID})
+	// the data channel may already be open without signaling, send it what's on the terminal
+	if client.termishareChannel != nil {
+		ts.pty.Refresh()
+	}
+	return message.TCAuthenticated
+}
+
+func (ts *Termishare) setViewer(ID string, client *Client) {
+	log.Printf("Client %s joined as a viewer", ID)
+	client.viewer = true
+	ts.emit(Event{Type: EventClientViewer, ClientID: ID})
+}
+
+// Whether client can see and type in the terminal
+func (ts *Termishare) isAllowed(client *Client) bool {
+	return !ts.isRequirePasscode() || client.authenticated
+}
+
 func (ts *Termishare) isAuthenticated(passcode string) bool {
 	return passcode == ts.passcode
 }
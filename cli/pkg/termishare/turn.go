@@ -0,0 +1,127 @@
+// Time-limited TURN credentials, following the TURN REST API scheme supported by coturn (use-auth-secret)
+// username is "expiry:user" and the credential is base64(HMAC-SHA1(secret, username)), so the TURN server
+// only needs the shared secret to check them, and they stop working once expired
+package termishare
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Gives the TURN servers in servers credentials for a client joining, see Options.TURNCredentials
+type TURNCredentialsFunc func(clientID string, servers []webrtc.ICEServer) ([]webrtc.ICEServer, error)
+
+// Mint credentials for user valid for ttl
+func NewTURNCredentials(secret string, user string, ttl time.Duration) (string, string) {
+	username := fmt.Sprintf("%d:%s", time.Now().Add(ttl).Unix(), user)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Use username and credential for every TURN server in servers
+func WithTURNCredentials(servers []webrtc.ICEServer, username string, credential string) []webrtc.ICEServer {
+	var result []webrtc.ICEServer
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			if isTURN(url) {
+				server.Username = username
+				server.Credential = credential
+				server.CredentialType = webrtc.ICECredentialTypePassword
+				break
+			}
+		}
+		result = append(result, server)
+	}
+	return result
+}
+
+// Mint new credentials valid for ttl for each client, from the secret shared with the TURN server
+func MintTURNCredentials(secret string, user string, ttl time.Duration) TURNCredentialsFunc {
+	return func(clientID string, servers []webrtc.ICEServer) ([]webrtc.ICEServer, error) {
+		username, credential := NewTURNCredentials(secret, user, ttl)
+		return WithTURNCredentials(servers, username, credential), nil
+	}
+}
+
+// Fetch credentials from a TURN REST API endpoint for clients, see FetchTURNCredentials
+// They're reused for the next clients while more than half of the ttl the endpoint answered with is left
+func EndpointTURNCredentials(endpoint string, user string) TURNCredentialsFunc {
+	var lock sync.Mutex
+	var cached []webrtc.ICEServer
+	var renewAt time.Time
+	return func(clientID string, servers []webrtc.ICEServer) ([]webrtc.ICEServer, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if cached != nil && time.Now().Before(renewAt) {
+			return cached, nil
+		}
+		result, ttl, err := fetchTURNCredentials(endpoint, user, servers)
+		if err != nil {
+			return nil, err
+		}
+		cached, renewAt = result, time.Now().Add(ttl/2)
+		return result, nil
+	}
+}
+
+// Response of a TURN REST API credential endpoint
+type turnCredentialResponse struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int      `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+// Fetch credentials for user from a TURN REST API endpoint, e.g. http://localhost:8080/turn
+// The endpoint is called with ?service=turn&username=user and answers with
+// {"username": "...", "password": "...", "ttl": 86400, "uris": ["turn:host:3478"]}
+// The TURN servers in servers get the credentials, or are replaced by the uris of the response if there are any
+func FetchTURNCredentials(endpoint string, user string, servers []webrtc.ICEServer) ([]webrtc.ICEServer, error) {
+	servers, _, err := fetchTURNCredentials(endpoint, user, servers)
+	return servers, err
+}
+
+// FetchTURNCredentials, also returns how long the credentials are valid
+func fetchTURNCredentials(endpoint string, user string, servers []webrtc.ICEServer) ([]webrtc.ICEServer, time.Duration, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid TURN credential endpoint: %s", err)
+	}
+	query := u.Query()
+	query.Set("service", "turn")
+	query.Set("username", user)
+	u.RawQuery = query.Encode()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to fetch TURN credentials: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Failed to fetch TURN credentials: %s", resp.Status)
+	}
+
+	var creds turnCredentialResponse
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, 0, fmt.Errorf("Failed to parse TURN credentials: %s", err)
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return nil, 0, fmt.Errorf("TURN credential endpoint returned no credentials")
+	}
+
+	if len(creds.URIs) > 0 {
+		servers = append(WithoutTURN(servers), webrtc.ICEServer{URLs: creds.URIs})
+	}
+	return WithTURNCredentials(servers, creds.Username, creds.Password), time.Duration(creds.TTL) * time.Second, nil
+}
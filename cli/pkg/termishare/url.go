@@ -0,0 +1,120 @@
+package termishare
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Where a signaling server is, e.g. https://example.com:8443/termishare behind a reverse proxy
+// Session urls are the server url with the session ID appended to the path: https://example.com:8443/termishare/sessionID
+type ServerURL struct {
+	// http or https
+	Scheme string
+	// host or host:port
+	Host string
+	// where the server is served under, without a trailing slash, empty at the root
+	Path string
+	// kept as is in session urls and sent to the server, e.g. a token for a reverse proxy
+	RawQuery string
+	// kept in session urls only
+	Fragment string
+}
+
+// Parse a server url: http, https, ws and wss are accepted, and no scheme is http like host:port
+func ParseServerURL(server string) (ServerURL, error) {
+	server = strings.TrimSpace(server)
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return ServerURL{}, fmt.Errorf("Invalid server url %s: %s", server, err)
+	}
+	var scheme string
+	switch u.Scheme {
+	case "http", "ws":
+		scheme = "http"
+	case "https", "wss":
+		scheme = "https"
+	default:
+		return ServerURL{}, fmt.Errorf("Invalid server url %s: expected http, https, ws or wss", server)
+	}
+	if u.Host == "" {
+		return ServerURL{}, fmt.Errorf("Invalid server url %s: no host", server)
+	}
+	return ServerURL{
+		Scheme:   scheme,
+		Host:     u.Host,
+		Path:     strings.TrimRight(u.Path, "/"),
+		RawQuery: u.RawQuery,
+		Fragment: u.Fragment,
+	}, nil
+}
+
+// Parse a session url into its server and session ID, the last part of the path
+// Websocket urls like wss://example.com/ws/sessionID are accepted too, only their /ws isn't part of the server's path
+func ParseSessionURL(session string) (ServerURL, string, error) {
+	server, err := ParseServerURL(session)
+	if err != nil {
+		return server, "", err
+	}
+	i := strings.LastIndex(server.Path, "/")
+	sessionID := server.Path[i+1:]
+	if sessionID == "" {
+		return server, "", fmt.Errorf("No session ID in %s", session)
+	}
+	server.Path = server.Path[:i]
+	scheme := strings.ToLower(strings.TrimSpace(session))
+	if strings.HasPrefix(scheme, "ws://") || strings.HasPrefix(scheme, "wss://") {
+		server.Path = strings.TrimSuffix(server.Path, "/ws")
+	}
+	return server, sessionID, nil
+}
+
+func (s ServerURL) url(path string) *url.URL {
+	return &url.URL{Scheme: s.Scheme, Host: s.Host, Path: s.Path + path, RawQuery: s.RawQuery, Fragment: s.Fragment}
+}
+
+func (s ServerURL) String() string {
+	return s.url("").String()
+}
+
+// Where clients join the session
+func (s ServerURL) SessionURL(sessionID string) string {
+	return s.url("/" + sessionID).String()
+}
+
+// The websocket of the session on the signaling server
+func (s ServerURL) WebSocketURL(sessionID string) string {
+	u := s.url("/ws/" + sessionID)
+	u.Scheme = "ws"
+	if s.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// The url of a session on server, or just both joined if server is invalid
+func sessionURL(server string, sessionID string) string {
+	serverURL, err := ParseServerURL(server)
+	if err != nil {
+		return server + "/" + sessionID
+	}
+	return serverURL.SessionURL(sessionID)
+}
+
+// Deprecated: use ParseServerURL and ServerURL.SessionURL
+func GetClientURL(client string, sessionID string) string {
+	return sessionURL(client, sessionID)
+}
+
+// Deprecated: use ParseServerURL and ServerURL.WebSocketURL
+func GetWSURL(server string, sessionID string) string {
+	serverURL, err := ParseServerURL(server)
+	if err != nil {
+		return server + "/ws/" + sessionID
+	}
+	return serverURL.WebSocketURL(sessionID)
+}
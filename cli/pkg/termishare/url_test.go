@@ -0,0 +1,94 @@
+package termishare
+
+import "testing"
+
+func TestParseServerURL(t *testing.T) {
+	tests := []struct {
+		server string
+		want   ServerURL
+		str    string
+		ws     string
+	}{
+		{"https://termishare.com", ServerURL{Scheme: "https", Host: "termishare.com"},
+			"https://termishare.com", "wss://termishare.com/ws/id"},
+		{"localhost:3000", ServerURL{Scheme: "http", Host: "localhost:3000"},
+			"http://localhost:3000", "ws://localhost:3000/ws/id"},
+		{"http://example.com:8080/termishare/", ServerURL{Scheme: "http", Host: "example.com:8080", Path: "/termishare"},
+			"http://example.com:8080/termishare", "ws://example.com:8080/termishare/ws/id"},
+		{"ws://example.com/ws", ServerURL{Scheme: "http", Host: "example.com", Path: "/ws"},
+			"http://example.com/ws", "ws://example.com/ws/ws/id"},
+		{"wss://example.com:8443/a/b", ServerURL{Scheme: "https", Host: "example.com:8443", Path: "/a/b"},
+			"https://example.com:8443/a/b", "wss://example.com:8443/a/b/ws/id"},
+		{"https://example.com/ts?token=abc#top", ServerURL{Scheme: "https", Host: "example.com", Path: "/ts", RawQuery: "token=abc", Fragment: "top"},
+			"https://example.com/ts?token=abc#top", "wss://example.com/ts/ws/id?token=abc"},
+	}
+	for _, tt := range tests {
+		got, err := ParseServerURL(tt.server)
+		if err != nil {
+			t.Errorf("ParseServerURL(%q): %s", tt.server, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseServerURL(%q) = %+v, want %+v", tt.server, got, tt.want)
+		}
+		if s := got.String(); s != tt.str {
+			t.Errorf("ParseServerURL(%q).String() = %q, want %q", tt.server, s, tt.str)
+		}
+		if ws := got.WebSocketURL("id"); ws != tt.ws {
+			t.Errorf("ParseServerURL(%q).WebSocketURL() = %q, want %q", tt.server, ws, tt.ws)
+		}
+		// printed urls parse back to the same server
+		if again, err := ParseServerURL(got.String()); err != nil || again != got {
+			t.Errorf("ParseServerURL(%q) doesn't round trip: %+v, %v", got.String(), again, err)
+		}
+	}
+
+	for _, server := range []string{"ftp://example.com", "http://", "https:///path"} {
+		if _, err := ParseServerURL(server); err == nil {
+			t.Errorf("ParseServerURL(%q) should fail", server)
+		}
+	}
+}
+
+func TestParseSessionURL(t *testing.T) {
+	tests := []struct {
+		session string
+		server  string
+		id      string
+		// the session url printed back, the input if empty
+		want string
+	}{
+		{"https://termishare.com/abc", "https://termishare.com", "abc", ""},
+		{"localhost:3000/abc", "http://localhost:3000", "abc", "http://localhost:3000/abc"},
+		{"http://example.com:8080/termishare/abc", "http://example.com:8080/termishare", "abc", ""},
+		// a base path that happens to end with /ws is kept
+		{"https://example.com/ws/abc", "https://example.com/ws", "abc", ""},
+		// the websocket of a session
+		{"ws://localhost:3000/ws/abc", "http://localhost:3000", "abc", "http://localhost:3000/abc"},
+		{"wss://example.com/termishare/ws/abc", "https://example.com/termishare", "abc", "https://example.com/termishare/abc"},
+		{"https://example.com/ts/abc?token=x#top", "https://example.com/ts?token=x#top", "abc", ""},
+	}
+	for _, tt := range tests {
+		server, id, err := ParseSessionURL(tt.session)
+		if err != nil {
+			t.Errorf("ParseSessionURL(%q): %s", tt.session, err)
+			continue
+		}
+		if server.String() != tt.server || id != tt.id {
+			t.Errorf("ParseSessionURL(%q) = %q, %q, want %q, %q", tt.session, server.String(), id, tt.server, tt.id)
+		}
+		want := tt.want
+		if want == "" {
+			want = tt.session
+		}
+		if got := server.SessionURL(id); got != want {
+			t.Errorf("ParseSessionURL(%q).SessionURL() = %q, want %q", tt.session, got, want)
+		}
+	}
+
+	for _, session := range []string{"https://termishare.com", "https://termishare.com/", "ftp://example.com/abc"} {
+		if _, _, err := ParseSessionURL(session); err == nil {
+			t.Errorf("ParseSessionURL(%q) should fail", session)
+		}
+	}
+}
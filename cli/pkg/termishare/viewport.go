@@ -0,0 +1,303 @@
+// When the client's terminal is smaller than the host's, RemoteClient can't just write what the host sends.
+// Instead it keeps a model of the host's screen and draws the part of it that fits, following the host's cursor.
+// The last line shows which directions have more content, and the view can be panned from the command menu
+package termishare
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qnkhuat/termishare/pkg/vt"
+)
+
+const (
+	// limit how often the viewport is redrawn
+	viewportRenderInterval = 30 * time.Millisecond
+	statusDuration         = 3 * time.Second
+)
+
+type viewport struct {
+	lock sync.Mutex
+
+	// enabled when the host's terminal doesn't fit in ours
+	enabled bool
+	// top left corner of the view on the host's screen
+	x, y int
+	// move the view to keep the host's cursor visible
+	follow bool
+	// waiting for pan keys after the escape key
+	panning bool
+
+	renderScheduled bool
+
+	status      string
+	statusUntil time.Time
+}
+
+// Size of the part of the terminal used to show the host's screen, the last line is kept for the indicators
+func (rc *RemoteClient) viewSize() (int, int) {
+	cols, rows := int(rc.winSizes.thisCols), int(rc.winSizes.thisRows)
+	if rows > 1 {
+		rows--
+	}
+	return cols, rows
+}
+
+func (rc *RemoteClient) setViewportEnabled(enabled bool) {
+	rc.view.lock.Lock()
+	rc.view.enabled = enabled
+	if enabled {
+		rc.view.follow = true
+	}
+	rc.view.panning = false
+	rc.view.lock.Unlock()
+	if enabled {
+		rc.renderViewport()
+	}
+}
+
+func (rc *RemoteClient) viewportEnabled() bool {
+	rc.view.lock.Lock()
+	defer rc.view.lock.Unlock()
+	return rc.view.enabled
+}
+
+func (rc *RemoteClient) isPanning() bool {
+	rc.view.lock.Lock()
+	defer rc.view.lock.Unlock()
+	return rc.view.panning
+}
+
+// Redraw the viewport soon, multiple calls in a short time only redraw once
+func (rc *RemoteClient) scheduleViewportRender() {
+	rc.view.lock.Lock()
+	defer rc.view.lock.Unlock()
+	if rc.view.renderScheduled {
+		return
+	}
+	rc.view.renderScheduled = true
+	time.AfterFunc(viewportRenderInterval, func() {
+		rc.view.lock.Lock()
+		rc.view.renderScheduled = false
+		rc.view.lock.Unlock()
+		rc.renderViewport()
+	})
+}
+
+// Pan the view by dx columns and dy rows, panning stops following the cursor
+func (rc *RemoteClient) panViewport(dx, dy int) {
+	rc.view.lock.Lock()
+	rc.view.follow = false
+	rc.view.x += dx
+	rc.view.y += dy
+	rc.view.lock.Unlock()
+	rc.renderViewport()
+}
+
+func (rc *RemoteClient) followCursor() {
+	rc.view.lock.Lock()
+	rc.view.follow = true
+	rc.view.lock.Unlock()
+	rc.renderViewport()
+}
+
+// Handle a key while panning, returns false when the key ends panning
+func (rc *RemoteClient) handlePanKey(key byte) bool {
+	viewCols, viewRows := rc.viewSize()
+	stepX, stepY := max(viewCols/4, 1), max(viewRows/2, 1)
+	switch key {
+	case 'h':
+		rc.panViewport(-stepX, 0)
+	case 'l':
+		rc.panViewport(stepX, 0)
+	case 'k':
+		rc.panViewport(0, -stepY)
+	case 'j':
+		rc.panViewport(0, stepY)
+	case 'f':
+		rc.followCursor()
+	default:
+		rc.view.lock.Lock()
+		rc.view.panning = false
+		rc.view.lock.Unlock()
+		rc.renderViewport()
+		return false
+	}
+	return true
+}
+
+func (rc *RemoteClient) renderViewport() {
+	if rc.screen == nil {
+		return
+	}
+
+	rc.view.lock.Lock()
+	defer rc.view.lock.Unlock()
+	if !rc.view.enabled {
+		return
+	}
+
+	hostCols, hostRows := rc.screen.Size()
+	viewCols, viewRows := rc.viewSize()
+	cx, cy, cursorVisible := rc.screen.Cursor()
+
+	v := &rc.view
+	if v.follow {
+		if cx < v.x {
+			v.x = cx
+		} else if cx >= v.x+viewCols {
+			v.x = cx - viewCols + 1
+		}
+		if cy < v.y {
+			v.y = cy
+		} else if cy >= v.y+viewRows {
+			v.y = cy - viewRows + 1
+		}
+	}
+	v.x = clampInt(v.x, 0, max(hostCols-viewCols, 0))
+	v.y = clampInt(v.y, 0, max(hostRows-viewRows, 0))
+
+	var b strings.Builder
+	// hide the cursor while drawing to avoid flickering
+	b.WriteString("\x1b[?25l")
+	for row := 0; row < viewRows; row++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H\x1b[0m", row+1)
+		line := rc.screen.Line(v.y + row)
+		current := vt.Cell{Fg: vt.DefaultColor, Bg: vt.DefaultColor}
+		for col := 0; col < viewCols; col++ {
+			x := v.x + col
+			cell := vt.Cell{Char: ' ', Fg: vt.DefaultColor, Bg: vt.DefaultColor}
+			if x < len(line) {
+				cell = line[x]
+			}
+			// half of a wide char cut by the edges of the view
+			if cell.Char == 0 || (col == viewCols-1 && x+1 < len(line) && line[x+1].Char == 0) {
+				cell.Char = ' '
+			}
+			if cell.Fg != current.Fg || cell.Bg != current.Bg || cell.Attr != current.Attr {
+				b.WriteString(sgr(cell))
+				current = cell
+			}
+			b.WriteRune(cell.Char)
+		}
+		b.WriteString("\x1b[0m\x1b[K")
+	}
+
+	if viewRows < int(rc.winSizes.thisRows) {
+		fmt.Fprintf(&b, "\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m", viewRows+1, truncate(rc.indicators(hostCols, hostRows, viewCols, viewRows), viewCols))
+	}
+
+	if cursorVisible && cx >= v.x && cx < v.x+viewCols && cy >= v.y && cy < v.y+viewRows {
+		fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", cy-v.y+1, cx-v.x+1)
+	}
+	os.Stdout.WriteString(b.String())
+}
+
+// The indicator line, must be called with the view lock held
+func (rc *RemoteClient) indicators(hostCols, hostRows, viewCols, viewRows int) string {
+	v := &rc.view
+	if v.status != "" && time.Now().Before(v.statusUntil) {
+		return v.status
+	}
+
+	arrow := func(show bool, s string) string {
+		if show {
+			return s
+		}
+		return " "
+	}
+	arrows := arrow(v.x > 0, "◀") + arrow(v.y > 0, "▲") + arrow(v.y+viewRows < hostRows, "▼") + arrow(v.x+viewCols < hostCols, "▶")
+
+	mode := "following cursor"
+	if !v.follow {
+		mode = "panned"
+	}
+	key := KeyName(rc.escapeKey)
+	help := fmt.Sprintf("%s h/j/k/l to pan, %s f to follow", key, key)
+	if v.panning {
+		help = "h/j/k/l to pan, f to follow, any other key to stop"
+	}
+	return fmt.Sprintf("%s cols %d-%d/%d rows %d-%d/%d, %s | %s",
+		arrows, v.x+1, min(v.x+viewCols, hostCols), hostCols, v.y+1, min(v.y+viewRows, hostRows), hostRows, mode, help)
+}
+
+// Show a message in the indicator line for a few seconds
+func (rc *RemoteClient) showViewportStatus(msg string) {
+	rc.view.lock.Lock()
+	rc.view.status = msg
+	rc.view.statusUntil = time.Now().Add(statusDuration)
+	rc.view.lock.Unlock()
+	rc.renderViewport()
+	time.AfterFunc(statusDuration, rc.scheduleViewportRender)
+}
+
+// Escape sequence to set the attributes of cell
+func sgr(cell vt.Cell) string {
+	params := []string{"0"}
+	for _, a := range []struct {
+		attr vt.Attr
+		code string
+	}{{vt.AttrBold, "1"}, {vt.AttrFaint, "2"}, {vt.AttrItalic, "3"}, {vt.AttrUnderline, "4"}, {vt.AttrBlink, "5"},
+		{vt.AttrReverse, "7"}, {vt.AttrHidden, "8"}, {vt.AttrStrike, "9"}} {
+		if cell.Attr&a.attr != 0 {
+			params = append(params, a.code)
+		}
+	}
+	if c := sgrColor(cell.Fg, 30, 90, 38); c != "" {
+		params = append(params, c)
+	}
+	if c := sgrColor(cell.Bg, 40, 100, 48); c != "" {
+		params = append(params, c)
+	}
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+func sgrColor(c vt.Color, base, brightBase, extended int) string {
+	switch {
+	case c == vt.DefaultColor:
+		return ""
+	case c.IsRGB():
+		r, g, b := c.Components()
+		return fmt.Sprintf("%d;2;%d;%d;%d", extended, r, g, b)
+	case c < 8:
+		return fmt.Sprint(base + int(c))
+	case c < 16:
+		return fmt.Sprint(brightBase + int(c) - 8)
+	}
+	return fmt.Sprintf("%d;5;%d", extended, c)
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return s
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,11 +1,21 @@
 package termishare
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
 	"github.com/gorilla/websocket"
 	"github.com/qnkhuat/termishare/internal/cfg"
 	"github.com/qnkhuat/termishare/pkg/message"
-	"log"
-	"time"
+)
+
+const (
+	// the connection is considered dead if nothing, not even a pong, is received for this long
+	wsPongTimeout  = 30 * time.Second
+	wsPingInterval = 10 * time.Second
 )
 
 // An extension of websocket with go channels
@@ -15,41 +25,71 @@ type WebSocket struct {
 	Out            chan message.Wrapper
 	lastActiveTime time.Time
 	active         bool
+	lock           sync.Mutex
+	// closed by Stop, Out isn't so senders waiting for room in it can't panic
+	done chan bool
 }
 
-func NewWebSocketConnection(url string) (*WebSocket, error) {
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+// Connect to url, through proxy: see Options.Proxy
+func NewWebSocketConnection(url string, proxy string, signaling SignalingOptions) (*WebSocket, error) {
+	return dialWebSocket(context.Background(), url, proxy, signaling)
+}
 
+// NewWebSocketConnection, giving up when ctx is done
+func dialWebSocket(ctx context.Context, url string, proxy string, signaling SignalingOptions) (*WebSocket, error) {
+	dialer, err := websocketDialer(proxy, url)
 	if err != nil {
 		return nil, err
 	}
+	dialer.TLSClientConfig, err = signaling.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, resp, err := dialer.DialContext(ctx, url, signaling.header())
 
-	return &WebSocket{
-		Conn:   conn,
-		In:     make(chan message.Wrapper, cfg.TERMISHARE_WEBSOCKET_CHANNEL_SIZE),
-		Out:    make(chan message.Wrapper, cfg.TERMISHARE_WEBSOCKET_CHANNEL_SIZE),
-		active: true,
-	}, nil
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, fmt.Errorf("Signaling server refused the connection: %s", resp.Status)
+	} else if err != nil {
+		return nil, err
+	}
+
+	ws := &WebSocket{
+		Conn:           conn,
+		In:             make(chan message.Wrapper, cfg.TERMISHARE_WEBSOCKET_CHANNEL_SIZE),
+		Out:            make(chan message.Wrapper, cfg.TERMISHARE_WEBSOCKET_CHANNEL_SIZE),
+		active:         true,
+		lastActiveTime: time.Now(),
+		done:           make(chan bool),
+	}
+	conn.SetPingHandler(func(appData string) error {
+		ws.touch()
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(wsPongTimeout))
+	})
+	conn.SetPongHandler(func(string) error {
+		ws.touch()
+		return nil
+	})
+	return ws, nil
 }
 
 // blocking method that start receive and send websocket message
 func (ws *WebSocket) Start() {
+	go ws.heartbeat()
+
 	// Receive message coroutine
 	go func() {
 		for {
-			msg, ok := <-ws.Out
-			ws.lastActiveTime = time.Now()
-			if ok {
+			select {
+			case msg := <-ws.Out:
+				ws.SetWriteDeadline(time.Now().Add(wsPongTimeout))
 				err := ws.WriteJSON(msg)
 				if err != nil {
 					log.Printf("Failed to send mesage : %s", err)
 					ws.Stop()
-					break
+					return
 				}
-			} else {
-				log.Printf("Failed to get message from channel")
-				ws.Stop()
-				break
+			case <-ws.done:
+				return
 			}
 		}
 	}()
@@ -59,6 +99,7 @@ func (ws *WebSocket) Start() {
 		msg := message.Wrapper{}
 		err := ws.ReadJSON(&msg)
 		if err == nil {
+			ws.touch()
 			ws.In <- msg // Will be handled in Room
 		} else {
 			log.Printf("Failed to read message. Closing connection: %s", err)
@@ -66,18 +107,91 @@ func (ws *WebSocket) Start() {
 			break
 		}
 	}
+	close(ws.In)
 	log.Printf("Out websocket")
 }
 
+// Queue a message to be sent, fails instead of panicking if the connection is already stopped
+func (ws *WebSocket) Send(msg message.Wrapper) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if !ws.active {
+		return fmt.Errorf("Websocket is closed")
+	}
+	select {
+	case ws.Out <- msg:
+		return nil
+	default:
+		return fmt.Errorf("Websocket send buffer is full")
+	}
+}
+
+// Queue a message to be sent, waiting up to timeout for room in the send buffer instead of failing right away
+func (ws *WebSocket) SendWait(msg message.Wrapper, timeout time.Duration) error {
+	if !ws.Active() {
+		return fmt.Errorf("Websocket is closed")
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ws.Out <- msg:
+		return nil
+	case <-ws.done:
+		return fmt.Errorf("Websocket is closed")
+	case <-timer.C:
+		return fmt.Errorf("Timed out waiting for room in the websocket send buffer")
+	}
+}
+
+// Ping the server, and stop if it stopped answering: a dead connection isn't always closed, e.g. after a network change
+func (ws *WebSocket) heartbeat() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !ws.Active() {
+			return
+		}
+		if idle := time.Since(ws.LastActive()); idle > wsPongTimeout {
+			log.Printf("No message from the server for %s, closing connection", idle.Round(time.Second))
+			ws.Stop()
+			return
+		}
+		if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsPingInterval)); err != nil {
+			log.Printf("Failed to ping server: %s", err)
+		}
+	}
+}
+
+func (ws *WebSocket) touch() {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.lastActiveTime = time.Now()
+}
+
+// When something was last received from the server
+func (ws *WebSocket) LastActive() time.Time {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.lastActiveTime
+}
+
+func (ws *WebSocket) Active() bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.active
+}
+
 // Gracefully close websocket connection
 func (ws *WebSocket) Stop() {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
 	if ws.active {
 		ws.active = false
 		log.Printf("Closing client")
-		ws.WriteControl(websocket.CloseMessage, []byte{}, time.Time{})
+		ws.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Second))
 		time.Sleep(1 * time.Second) // give client sometimes to receive the control message
-		close(ws.In)
-		close(ws.Out)
+		// In is closed by Start once it stops reading
+		close(ws.done)
 		ws.Close()
 	}
 }
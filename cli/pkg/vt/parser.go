@@ -0,0 +1,414 @@
+package vt
+
+import (
+	"unicode/utf8"
+)
+
+type parserState int
+
+const (
+	stateGround parserState = iota
+	stateEscape
+	stateEscapeIntermediate
+	stateCSI
+	stateOSC
+	// DCS, SOS, PM and APC strings, all ignored until the string terminator
+	stateString
+	stateStringEscape
+	// waiting for the charset byte after ESC ( ESC ) and friends
+	stateCharset
+)
+
+const maxParams = 16
+
+type parser struct {
+	state parserState
+
+	// csi
+	params       []int
+	param        int
+	paramSet     bool
+	private      byte
+	intermediate byte
+
+	// partial utf-8 sequence
+	utf8Buf [utf8.UTFMax]byte
+	utf8Len int
+}
+
+func (p *parser) feed(s *Screen, b byte) {
+	// CAN and SUB abort any sequence
+	if b == 0x18 || b == 0x1a {
+		p.state = stateGround
+		return
+	}
+
+	switch p.state {
+	case stateGround:
+		p.ground(s, b)
+
+	case stateEscape:
+		p.escape(s, b)
+
+	case stateEscapeIntermediate:
+		if b >= 0x30 && b <= 0x7e {
+			p.state = stateGround
+		}
+
+	case stateCharset:
+		p.state = stateGround
+
+	case stateCSI:
+		p.csi(s, b)
+
+	case stateOSC:
+		switch b {
+		case 0x07:
+			p.state = stateGround
+		case 0x1b:
+			p.state = stateStringEscape
+		}
+
+	case stateString:
+		if b == 0x1b {
+			p.state = stateStringEscape
+		}
+
+	case stateStringEscape:
+		if b == '\\' {
+			p.state = stateGround
+		} else {
+			// not a string terminator, treat it as the start of a new escape sequence
+			p.state = stateEscape
+			p.escape(s, b)
+		}
+	}
+}
+
+func (p *parser) ground(s *Screen, b byte) {
+	if p.utf8Len > 0 || b >= 0x80 {
+		p.utf8(s, b)
+		return
+	}
+
+	switch {
+	case b == 0x1b:
+		p.state = stateEscape
+	case b < 0x20 || b == 0x7f:
+		p.control(s, b)
+	default:
+		s.put(rune(b))
+	}
+}
+
+func (p *parser) utf8(s *Screen, b byte) {
+	if p.utf8Len > 0 && (b < 0x80 || b >= 0xc0) {
+		// broken sequence, drop what we have and start over with this byte
+		p.utf8Len = 0
+		s.put(utf8.RuneError)
+		p.ground(s, b)
+		return
+	}
+
+	p.utf8Buf[p.utf8Len] = b
+	p.utf8Len++
+	if !utf8.FullRune(p.utf8Buf[:p.utf8Len]) {
+		return
+	}
+	r, _ := utf8.DecodeRune(p.utf8Buf[:p.utf8Len])
+	p.utf8Len = 0
+	s.put(r)
+}
+
+func (p *parser) control(s *Screen, b byte) {
+	switch b {
+	case '\b':
+		if s.cur.x > 0 {
+			s.cur.x--
+		}
+		s.cur.wrapNext = false
+	case '\t':
+		s.tab(1)
+	case '\n', '\v', '\f':
+		s.lineFeed()
+		s.cur.wrapNext = false
+	case '\r':
+		s.cur.x = 0
+		s.cur.wrapNext = false
+	}
+}
+
+func (p *parser) escape(s *Screen, b byte) {
+	p.state = stateGround
+	switch b {
+	case '[':
+		p.state = stateCSI
+		p.params = p.params[:0]
+		p.param = 0
+		p.paramSet = false
+		p.private = 0
+		p.intermediate = 0
+	case ']':
+		p.state = stateOSC
+	case 'P', 'X', '^', '_':
+		p.state = stateString
+	case '(', ')', '*', '+', '-', '.', '/', '#', '%':
+		p.state = stateCharset
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.cur.x = 0
+		s.lineFeed()
+	case 'M':
+		s.reverseLineFeed()
+	case 'c':
+		s.fullReset()
+	case 0x1b:
+		p.state = stateEscape
+	default:
+		if b >= 0x20 && b <= 0x2f {
+			p.state = stateEscapeIntermediate
+		}
+	}
+}
+
+func (p *parser) csi(s *Screen, b byte) {
+	switch {
+	case b >= '0' && b <= '9':
+		p.param = p.param*10 + int(b-'0')
+		if p.param > 65535 {
+			p.param = 65535
+		}
+		p.paramSet = true
+	case b == ';' || b == ':':
+		p.pushParam()
+	case b >= '<' && b <= '?':
+		p.private = b
+	case b >= 0x20 && b <= 0x2f:
+		p.intermediate = b
+	case b >= 0x40 && b <= 0x7e:
+		p.pushParam()
+		p.state = stateGround
+		p.dispatchCSI(s, b)
+	case b < 0x20:
+		// control characters are executed in the middle of a sequence
+		p.control(s, b)
+	default:
+		p.state = stateGround
+	}
+}
+
+func (p *parser) pushParam() {
+	if len(p.params) < maxParams {
+		if p.paramSet {
+			p.params = append(p.params, p.param)
+		} else {
+			p.params = append(p.params, -1)
+		}
+	}
+	p.param = 0
+	p.paramSet = false
+}
+
+// Returns the i-th parameter or def if it's missing or 0
+func (p *parser) arg(i, def int) int {
+	if i >= len(p.params) || p.params[i] <= 0 {
+		return def
+	}
+	return p.params[i]
+}
+
+func (p *parser) dispatchCSI(s *Screen, final byte) {
+	if p.intermediate != 0 {
+		// things like DECSCUSR (cursor style), nothing to do with the content
+		return
+	}
+
+	if p.private == '?' {
+		switch final {
+		case 'h':
+			p.setPrivateModes(s, true)
+		case 'l':
+			p.setPrivateModes(s, false)
+		}
+		return
+	} else if p.private != 0 {
+		return
+	}
+
+	switch final {
+	case '@':
+		s.insertChars(p.arg(0, 1))
+	case 'A':
+		s.moveTo(s.cur.x, s.cur.y-p.arg(0, 1))
+	case 'B', 'e':
+		s.moveTo(s.cur.x, s.cur.y+p.arg(0, 1))
+	case 'C', 'a':
+		s.moveTo(s.cur.x+p.arg(0, 1), s.cur.y)
+	case 'D':
+		s.moveTo(s.cur.x-p.arg(0, 1), s.cur.y)
+	case 'E':
+		s.moveTo(0, s.cur.y+p.arg(0, 1))
+	case 'F':
+		s.moveTo(0, s.cur.y-p.arg(0, 1))
+	case 'G', '`':
+		s.moveTo(p.arg(0, 1)-1, s.cur.y)
+	case 'H', 'f':
+		s.moveTo(p.arg(1, 1)-1, p.arg(0, 1)-1)
+	case 'I':
+		s.tab(p.arg(0, 1))
+	case 'J':
+		s.eraseDisplay(p.arg(0, 0))
+	case 'K':
+		s.eraseLine(p.arg(0, 0))
+	case 'L':
+		s.insertLines(p.arg(0, 1))
+	case 'M':
+		s.deleteLines(p.arg(0, 1))
+	case 'P':
+		s.deleteChars(p.arg(0, 1))
+	case 'S':
+		s.scrollUp(p.arg(0, 1))
+	case 'T':
+		s.scrollDown(p.arg(0, 1))
+	case 'X':
+		s.eraseChars(p.arg(0, 1))
+	case 'Z':
+		s.backTab(p.arg(0, 1))
+	case 'b':
+		if s.lastChar != 0 {
+			for i := p.arg(0, 1); i > 0; i-- {
+				s.put(s.lastChar)
+			}
+		}
+	case 'd':
+		s.moveTo(s.cur.x, p.arg(0, 1)-1)
+	case 'm':
+		p.sgr(s)
+	case 'r':
+		s.setScrollRegion(p.arg(0, 1), p.arg(1, s.rows))
+	case 's':
+		s.saveCursor()
+	case 'u':
+		s.restoreCursor()
+	}
+}
+
+func (p *parser) setPrivateModes(s *Screen, set bool) {
+	for _, mode := range p.params {
+		switch mode {
+		case 7:
+			s.autowrap = set
+		case 25:
+			s.cursorVisible = set
+		case 47, 1047:
+			if set {
+				s.enterAltScreen()
+			} else {
+				s.exitAltScreen()
+			}
+		case 1048:
+			if set {
+				s.saveCursor()
+			} else {
+				s.restoreCursor()
+			}
+		case 1049:
+			if set {
+				s.saveCursor()
+				s.enterAltScreen()
+				s.eraseDisplay(2)
+			} else {
+				s.exitAltScreen()
+				s.restoreCursor()
+			}
+		}
+	}
+}
+
+func (p *parser) sgr(s *Screen) {
+	pen := &s.cur.pen
+	if len(p.params) == 0 {
+		p.params = append(p.params, 0)
+	}
+
+	for i := 0; i < len(p.params); i++ {
+		v := p.params[i]
+		if v < 0 {
+			v = 0
+		}
+		switch {
+		case v == 0:
+			*pen = blankCell
+		case v == 1:
+			pen.Attr |= AttrBold
+		case v == 2:
+			pen.Attr |= AttrFaint
+		case v == 3:
+			pen.Attr |= AttrItalic
+		case v == 4:
+			pen.Attr |= AttrUnderline
+		case v == 5 || v == 6:
+			pen.Attr |= AttrBlink
+		case v == 7:
+			pen.Attr |= AttrReverse
+		case v == 8:
+			pen.Attr |= AttrHidden
+		case v == 9:
+			pen.Attr |= AttrStrike
+		case v == 21 || v == 22:
+			pen.Attr &^= AttrBold | AttrFaint
+		case v == 23:
+			pen.Attr &^= AttrItalic
+		case v == 24:
+			pen.Attr &^= AttrUnderline
+		case v == 25:
+			pen.Attr &^= AttrBlink
+		case v == 27:
+			pen.Attr &^= AttrReverse
+		case v == 28:
+			pen.Attr &^= AttrHidden
+		case v == 29:
+			pen.Attr &^= AttrStrike
+		case v >= 30 && v <= 37:
+			pen.Fg = Color(v - 30)
+		case v == 38:
+			pen.Fg, i = p.extendedColor(i, pen.Fg)
+		case v == 39:
+			pen.Fg = DefaultColor
+		case v >= 40 && v <= 47:
+			pen.Bg = Color(v - 40)
+		case v == 48:
+			pen.Bg, i = p.extendedColor(i, pen.Bg)
+		case v == 49:
+			pen.Bg = DefaultColor
+		case v >= 90 && v <= 97:
+			pen.Fg = Color(v - 90 + 8)
+		case v >= 100 && v <= 107:
+			pen.Bg = Color(v - 100 + 8)
+		}
+	}
+}
+
+// parse 38;5;n and 38;2;r;g;b, returns the color and the index of the last consumed param
+func (p *parser) extendedColor(i int, current Color) (Color, int) {
+	if i+1 >= len(p.params) {
+		return current, i
+	}
+	switch p.params[i+1] {
+	case 5:
+		if i+2 < len(p.params) {
+			return Color(clamp(p.params[i+2], 0, 255)), i + 2
+		}
+	case 2:
+		if i+4 < len(p.params) {
+			c := func(v int) uint8 { return uint8(clamp(v, 0, 255)) }
+			return RGB(c(p.params[i+2]), c(p.params[i+3]), c(p.params[i+4])), i + 4
+		}
+	}
+	return current, len(p.params) - 1
+}
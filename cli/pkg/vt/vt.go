@@ -0,0 +1,609 @@
+/*
+A minimal in-memory terminal emulator
+Feed it the bytes a program writes to its tty and it keeps track of what the screen looks like
+Used to turn recordings into text and to render the host's screen on a smaller terminal
+*/
+package vt
+
+import (
+	"strings"
+	"sync"
+)
+
+// Color is either DefaultColor, a 256-color palette index, or a 24-bit RGB value marked with ColorRGB
+type Color int32
+
+const (
+	DefaultColor Color = -1
+	ColorRGB     Color = 1 << 24
+)
+
+func RGB(r, g, b uint8) Color {
+	return ColorRGB | Color(r)<<16 | Color(g)<<8 | Color(b)
+}
+
+func (c Color) IsRGB() bool {
+	return c >= 0 && c&ColorRGB != 0
+}
+
+// Returns the r, g, b components of a RGB color
+func (c Color) Components() (uint8, uint8, uint8) {
+	return uint8(c >> 16), uint8(c >> 8), uint8(c)
+}
+
+type Attr uint16
+
+const (
+	AttrBold Attr = 1 << iota
+	AttrFaint
+	AttrItalic
+	AttrUnderline
+	AttrBlink
+	AttrReverse
+	AttrHidden
+	AttrStrike
+)
+
+type Cell struct {
+	// 0 means the cell is the right half of a wide character
+	Char rune
+	Fg   Color
+	Bg   Color
+	Attr Attr
+}
+
+var blankCell = Cell{Char: ' ', Fg: DefaultColor, Bg: DefaultColor}
+
+type cursor struct {
+	x, y int
+	pen  Cell
+	// set when the cursor is at the right margin and the next char should wrap
+	wrapNext bool
+}
+
+type Screen struct {
+	lock sync.RWMutex
+
+	cols, rows int
+	lines      [][]Cell
+	// the main screen is stashed here while the alternate screen is active
+	mainLines [][]Cell
+	altActive bool
+
+	cur   cursor
+	saved cursor
+
+	// scroll region, inclusive
+	top, bottom int
+
+	autowrap      bool
+	cursorVisible bool
+	tabWidth      int
+	lastChar      rune
+
+	// lines scrolled off the top of the main screen
+	scrollback      [][]Cell
+	scrollbackLimit int
+	// see SetKeepCleared
+	keepCleared bool
+
+	parser parser
+}
+
+func New(cols, rows int) *Screen {
+	s := &Screen{}
+	s.reset(cols, rows)
+	return s
+}
+
+func (s *Screen) reset(cols, rows int) {
+	if cols < 1 {
+		cols = 1
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	s.cols, s.rows = cols, rows
+	s.lines = newLines(cols, rows)
+	s.mainLines = nil
+	s.altActive = false
+	s.cur = cursor{pen: blankCell}
+	s.saved = s.cur
+	s.top, s.bottom = 0, rows-1
+	s.autowrap = true
+	s.cursorVisible = true
+	s.tabWidth = 8
+	s.parser = parser{}
+}
+
+// Keep at most limit lines that scrolled off the top of the screen
+// 0 disables scrollback and a negative limit keeps every line
+func (s *Screen) SetScrollback(limit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scrollbackLimit = limit
+	s.trimScrollback()
+}
+
+// Push what clearing the main screen erases to scrollback, and don't let programs clear scrollback
+// For transcripts, where a clear mustn't lose what was printed before it
+func (s *Screen) SetKeepCleared(keep bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keepCleared = keep
+}
+
+// Write feeds terminal output to the screen. It never fails
+func (s *Screen) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, b := range p {
+		s.parser.feed(s, b)
+	}
+	return len(p), nil
+}
+
+func (s *Screen) Size() (int, int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cols, s.rows
+}
+
+// Returns the cursor position and whether it's visible
+func (s *Screen) Cursor() (int, int, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	x := s.cur.x
+	if x >= s.cols {
+		x = s.cols - 1
+	}
+	return x, s.cur.y, s.cursorVisible
+}
+
+func (s *Screen) Cell(x, y int) Cell {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if y < 0 || y >= s.rows || x < 0 || x >= s.cols {
+		return blankCell
+	}
+	return s.lines[y][x]
+}
+
+// Returns a copy of the line at row y
+func (s *Screen) Line(y int) []Cell {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if y < 0 || y >= s.rows {
+		return nil
+	}
+	return append([]Cell(nil), s.lines[y]...)
+}
+
+// Returns a copy of the lines that scrolled off the screen, oldest first
+func (s *Screen) Scrollback() [][]Cell {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	lines := make([][]Cell, len(s.scrollback))
+	for i, l := range s.scrollback {
+		lines[i] = append([]Cell(nil), l...)
+	}
+	return lines
+}
+
+func (s *Screen) AltScreen() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.altActive
+}
+
+func (s *Screen) Resize(cols, rows int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cols < 1 {
+		cols = 1
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	if cols == s.cols && rows == s.rows {
+		return
+	}
+
+	// when shrinking, push lines above the cursor to scrollback so the cursor stays on screen
+	if !s.altActive {
+		for s.cur.y >= rows {
+			s.pushScrollback(s.lines[0])
+			s.lines = s.lines[1:]
+			s.cur.y--
+			s.saved.y--
+		}
+	} else if s.cur.y >= rows {
+		s.cur.y = rows - 1
+	}
+	s.lines = resizeLines(s.lines, cols, rows)
+	if s.mainLines != nil {
+		s.mainLines = resizeLines(s.mainLines, cols, rows)
+	}
+
+	s.cols, s.rows = cols, rows
+	s.top, s.bottom = 0, rows-1
+	s.cur.x = clamp(s.cur.x, 0, cols-1)
+	s.cur.y = clamp(s.cur.y, 0, rows-1)
+	s.saved.x = clamp(s.saved.x, 0, cols-1)
+	s.saved.y = clamp(s.saved.y, 0, rows-1)
+	s.cur.wrapNext = false
+}
+
+// Returns the text of a line without trailing spaces
+func LineString(line []Cell) string {
+	var b strings.Builder
+	for _, c := range line {
+		if c.Char == 0 {
+			continue
+		}
+		b.WriteRune(c.Char)
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// Returns the visible text of the screen, one line per row
+func (s *Screen) String() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	lines := make([]string, s.rows)
+	for i, l := range s.lines {
+		lines[i] = LineString(l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// *** Screen operations, called by the parser with the lock held ***
+
+func (s *Screen) put(r rune) {
+	width := runeWidth(r)
+	if width == 0 {
+		// combining characters are dropped, we only keep one rune per cell
+		return
+	}
+
+	if s.cur.wrapNext || s.cur.x+width > s.cols {
+		if s.autowrap {
+			s.cur.x = 0
+			s.lineFeed()
+		} else {
+			s.cur.x = s.cols - width
+		}
+		s.cur.wrapNext = false
+	}
+	if s.cur.x < 0 {
+		s.cur.x = 0
+	}
+
+	cell := s.cur.pen
+	cell.Char = r
+	line := s.lines[s.cur.y]
+	line[s.cur.x] = cell
+	if width == 2 && s.cur.x+1 < s.cols {
+		cell.Char = 0
+		line[s.cur.x+1] = cell
+	}
+	s.lastChar = r
+
+	if s.cur.x+width >= s.cols {
+		s.cur.x = s.cols - 1
+		s.cur.wrapNext = true
+	} else {
+		s.cur.x += width
+	}
+}
+
+func (s *Screen) lineFeed() {
+	if s.cur.y == s.bottom {
+		s.scrollUp(1)
+	} else if s.cur.y < s.rows-1 {
+		s.cur.y++
+	}
+}
+
+func (s *Screen) reverseLineFeed() {
+	if s.cur.y == s.top {
+		s.scrollDown(1)
+	} else if s.cur.y > 0 {
+		s.cur.y--
+	}
+}
+
+// scroll the scroll region up by n lines, the top lines go to scrollback if it's the whole main screen
+func (s *Screen) scrollUp(n int) {
+	height := s.bottom - s.top + 1
+	if n > height {
+		n = height
+	}
+	for i := 0; i < n; i++ {
+		removed := s.lines[s.top]
+		if s.top == 0 && !s.altActive {
+			s.pushScrollback(removed)
+		}
+		copy(s.lines[s.top:s.bottom], s.lines[s.top+1:s.bottom+1])
+		s.lines[s.bottom] = s.blankLine()
+	}
+}
+
+func (s *Screen) scrollDown(n int) {
+	height := s.bottom - s.top + 1
+	if n > height {
+		n = height
+	}
+	for i := 0; i < n; i++ {
+		copy(s.lines[s.top+1:s.bottom+1], s.lines[s.top:s.bottom])
+		s.lines[s.top] = s.blankLine()
+	}
+}
+
+func (s *Screen) pushScrollback(line []Cell) {
+	if s.scrollbackLimit == 0 {
+		return
+	}
+	s.scrollback = append(s.scrollback, append([]Cell(nil), line...))
+	s.trimScrollback()
+}
+
+func (s *Screen) trimScrollback() {
+	if s.scrollbackLimit >= 0 && len(s.scrollback) > s.scrollbackLimit {
+		s.scrollback = append([][]Cell(nil), s.scrollback[len(s.scrollback)-s.scrollbackLimit:]...)
+	}
+}
+
+// a blank line with the current background color, like real terminals do on erase
+func (s *Screen) blankLine() []Cell {
+	line := make([]Cell, s.cols)
+	s.eraseCells(line)
+	return line
+}
+
+func (s *Screen) eraseCells(cells []Cell) {
+	blank := blankCell
+	blank.Bg = s.cur.pen.Bg
+	for i := range cells {
+		cells[i] = blank
+	}
+}
+
+func (s *Screen) moveTo(x, y int) {
+	s.cur.x = clamp(x, 0, s.cols-1)
+	s.cur.y = clamp(y, 0, s.rows-1)
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	// ESC[2J, or ESC[J from the top left corner like some clear commands do
+	if s.keepCleared && !s.altActive && (mode == 2 || mode == 0 && s.cur.x == 0 && s.cur.y == 0) {
+		s.pushScreen()
+	}
+	switch mode {
+	case 0:
+		s.eraseLine(0)
+		for y := s.cur.y + 1; y < s.rows; y++ {
+			s.eraseCells(s.lines[y])
+		}
+	case 1:
+		s.eraseLine(1)
+		for y := 0; y < s.cur.y; y++ {
+			s.eraseCells(s.lines[y])
+		}
+	case 2, 3:
+		for y := 0; y < s.rows; y++ {
+			s.eraseCells(s.lines[y])
+		}
+		if mode == 3 && !s.keepCleared {
+			s.scrollback = nil
+		}
+	}
+}
+
+// push the lines of the screen to scrollback, up to the last one that isn't blank
+func (s *Screen) pushScreen() {
+	last := -1
+	for y := 0; y < s.rows; y++ {
+		if LineString(s.lines[y]) != "" {
+			last = y
+		}
+	}
+	for y := 0; y <= last; y++ {
+		s.pushScrollback(s.lines[y])
+	}
+}
+
+func (s *Screen) eraseLine(mode int) {
+	line := s.lines[s.cur.y]
+	x := clamp(s.cur.x, 0, s.cols-1)
+	switch mode {
+	case 0:
+		s.eraseCells(line[x:])
+	case 1:
+		s.eraseCells(line[:x+1])
+	case 2:
+		s.eraseCells(line)
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) insertLines(n int) {
+	if s.cur.y < s.top || s.cur.y > s.bottom {
+		return
+	}
+	top := s.top
+	s.top = s.cur.y
+	s.scrollDown(n)
+	s.top = top
+	s.cur.x = 0
+}
+
+func (s *Screen) deleteLines(n int) {
+	if s.cur.y < s.top || s.cur.y > s.bottom {
+		return
+	}
+	top := s.top
+	s.top = s.cur.y
+	// lines removed from the middle of the screen never go to scrollback
+	limit := s.scrollbackLimit
+	s.scrollbackLimit = 0
+	s.scrollUp(n)
+	s.scrollbackLimit = limit
+	s.top = top
+	s.cur.x = 0
+}
+
+func (s *Screen) insertChars(n int) {
+	line := s.lines[s.cur.y]
+	x := clamp(s.cur.x, 0, s.cols-1)
+	if n > s.cols-x {
+		n = s.cols - x
+	}
+	copy(line[x+n:], line[x:])
+	s.eraseCells(line[x : x+n])
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) deleteChars(n int) {
+	line := s.lines[s.cur.y]
+	x := clamp(s.cur.x, 0, s.cols-1)
+	if n > s.cols-x {
+		n = s.cols - x
+	}
+	copy(line[x:], line[x+n:])
+	s.eraseCells(line[s.cols-n:])
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) eraseChars(n int) {
+	line := s.lines[s.cur.y]
+	x := clamp(s.cur.x, 0, s.cols-1)
+	if n > s.cols-x {
+		n = s.cols - x
+	}
+	s.eraseCells(line[x : x+n])
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) tab(n int) {
+	for i := 0; i < n; i++ {
+		next := (s.cur.x/s.tabWidth + 1) * s.tabWidth
+		if next >= s.cols {
+			next = s.cols - 1
+		}
+		s.cur.x = next
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) backTab(n int) {
+	for i := 0; i < n && s.cur.x > 0; i++ {
+		s.cur.x = ((s.cur.x - 1) / s.tabWidth) * s.tabWidth
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) setScrollRegion(top, bottom int) {
+	if bottom <= 0 || bottom > s.rows {
+		bottom = s.rows
+	}
+	if top < 1 {
+		top = 1
+	}
+	if top >= bottom {
+		return
+	}
+	s.top, s.bottom = top-1, bottom-1
+	s.moveTo(0, 0)
+}
+
+func (s *Screen) saveCursor() {
+	s.saved = s.cur
+}
+
+func (s *Screen) restoreCursor() {
+	s.cur = s.saved
+	s.cur.x = clamp(s.cur.x, 0, s.cols-1)
+	s.cur.y = clamp(s.cur.y, 0, s.rows-1)
+}
+
+func (s *Screen) enterAltScreen() {
+	if s.altActive {
+		return
+	}
+	s.mainLines = s.lines
+	s.lines = newLines(s.cols, s.rows)
+	s.altActive = true
+}
+
+func (s *Screen) exitAltScreen() {
+	if !s.altActive {
+		return
+	}
+	s.lines = s.mainLines
+	s.mainLines = nil
+	s.altActive = false
+}
+
+func (s *Screen) fullReset() {
+	limit := s.scrollbackLimit
+	scrollback := s.scrollback
+	s.reset(s.cols, s.rows)
+	s.scrollbackLimit = limit
+	s.scrollback = scrollback
+}
+
+// *** Helpers ***
+
+func newLines(cols, rows int) [][]Cell {
+	lines := make([][]Cell, rows)
+	for i := range lines {
+		lines[i] = make([]Cell, cols)
+		for j := range lines[i] {
+			lines[i][j] = blankCell
+		}
+	}
+	return lines
+}
+
+func resizeLines(lines [][]Cell, cols, rows int) [][]Cell {
+	resized := newLines(cols, rows)
+	for y := 0; y < rows && y < len(lines); y++ {
+		copy(resized[y], lines[y])
+	}
+	return resized
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Number of columns a rune takes on a terminal
+// Only covers the common wide ranges (CJK, hangul, fullwidth forms and emoji)
+func runeWidth(r rune) int {
+	switch {
+	case r == 0:
+		return 0
+	case r >= 0x300 && r <= 0x36f, r >= 0x200b && r <= 0x200f, r >= 0xfe00 && r <= 0xfe0f:
+		return 0
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0xa4cf && r != 0x303f,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,109 @@
+package vt
+
+import (
+	"strings"
+	"testing"
+)
+
+// The scrollback and the screen as text, without the blank lines at the bottom
+func transcript(s *Screen) string {
+	var lines []string
+	for _, line := range s.Scrollback() {
+		lines = append(lines, LineString(line))
+	}
+	lines = append(lines, strings.Split(s.String(), "\n")...)
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestScreen(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"plain", "hello\r\nworld", "hello\nworld"},
+		{"colors are stripped", "\x1b[1;31mred\x1b[0m and \x1b[38;2;1;2;3mrgb\x1b[m", "red and rgb"},
+		{"titles and modes are stripped", "\x1b]0;title\x07\x1b[?25l\x1b[?2004hprompt$ ", "prompt$"},
+		{"carriage return redraws", "progress 10%\rprogress 99%\rdone        ", "done"},
+		{"erase line redraws", "downloading...\r\x1b[2Kfinished", "finished"},
+		{"cursor moves overwrite", "aaaa\r\nbbbb\x1b[1;1Hx\x1b[2;4Hy", "xaaa\nbbby"},
+		{"backspace", "abc\b\bX", "aXc"},
+		{"tabs", "a\tb", "a       b"},
+		{"wrap", strings.Repeat("x", 22), strings.Repeat("x", 20) + "\nxx"},
+		{"wide characters", "日本", "日本"},
+		{"alternate screen is separate", "main\x1b[?1049hfull screen app\x1b[?1049l", "main"},
+		{"lines scroll off into scrollback", "1\r\n2\r\n3\r\n4\r\n5\r\n6", "1\n2\n3\n4\n5\n6"},
+		{"insert and delete lines don't reach scrollback", "1\r\n2\r\n3\x1b[1;1H\x1b[M\x1b[L", "\n2\n3"},
+		{"clear keeps what was printed before", "before\r\nclear\x1b[H\x1b[2J\x1b[3Jafter", "before\nclear\nafter"},
+		{"clear from the top left corner", "before\x1b[H\x1b[Jafter", "before\nafter"},
+		{"erase below the cursor is lost", "1\r\n2\r\n3\x1b[2;1H\x1b[J", "1"},
+		{"full screen app redraws aren't kept", "\x1b[?1049h\x1b[2Jframe 1\x1b[2Jframe 2\x1b[?1049lback", "back"},
+	}
+	for _, tt := range tests {
+		s := New(20, 4)
+		s.SetScrollback(-1)
+		s.SetKeepCleared(true)
+		s.Write([]byte(tt.output))
+		if got := transcript(s); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScrollbackLimit(t *testing.T) {
+	s := New(10, 2)
+	s.SetScrollback(2)
+	s.Write([]byte("1\r\n2\r\n3\r\n4\r\n5"))
+	if got := transcript(s); got != "2\n3\n4\n5" {
+		t.Errorf("Expected the last 2 lines in scrollback, got %q", got)
+	}
+
+	s = New(10, 2)
+	s.Write([]byte("1\r\n2\r\n3"))
+	if got := len(s.Scrollback()); got != 0 {
+		t.Errorf("Expected no scrollback by default, got %d lines", got)
+	}
+}
+
+// Without SetKeepCleared, clearing behaves like a terminal
+func TestClear(t *testing.T) {
+	s := New(10, 2)
+	s.SetScrollback(-1)
+	s.Write([]byte("1\r\n2\r\n3\x1b[H\x1b[2J"))
+	if got := transcript(s); got != "1" {
+		t.Errorf("Expected only the scrolled-off line, got %q", got)
+	}
+	s.Write([]byte("\x1b[3J"))
+	if got := transcript(s); got != "" {
+		t.Errorf("Expected scrollback to be cleared, got %q", got)
+	}
+}
+
+func TestSplitWrites(t *testing.T) {
+	output := "\x1b[31mred\x1b[0m 日本\r\n\x1b[2;3Hx"
+	whole := New(10, 4)
+	whole.Write([]byte(output))
+	split := New(10, 4)
+	for i := 0; i < len(output); i++ {
+		split.Write([]byte{output[i]})
+	}
+	if whole.String() != split.String() {
+		t.Errorf("Writing byte by byte gives %q, want %q", split.String(), whole.String())
+	}
+}
+
+func TestResize(t *testing.T) {
+	s := New(10, 4)
+	s.SetScrollback(-1)
+	s.Write([]byte("1\r\n2\r\n3\r\n4"))
+	s.Resize(10, 2)
+	if got := transcript(s); got != "1\n2\n3\n4" {
+		t.Errorf("Expected the lines above the cursor in scrollback, got %q", got)
+	}
+	if x, y, _ := s.Cursor(); x != 1 || y != 1 {
+		t.Errorf("Expected the cursor to stay after the last line, got %d,%d", x, y)
+	}
+}